@@ -0,0 +1,622 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Aggregator fetches a set of feeds and combines their entries into a single
+// list for output.
+type Aggregator struct {
+	Client *http.Client
+	// Cache holds entries from earlier runs for conditional requests. It
+	// may be nil.
+	Cache *feedCache
+	// Resolver follows entry links to their final URL. It may be nil.
+	Resolver *linkResolver
+	// FeedTimeout is how long to give each feed that doesn't set its own
+	// timeout.
+	FeedTimeout time.Duration
+	// Concurrency is the most feeds fetched at once, defaulting to
+	// defaultConcurrency.
+	Concurrency int
+	// Force fetches feeds even while the cache says they are fresh.
+	Force bool
+	// Latencies, if set, lengthens the timeout for hosts that are usually
+	// slow.
+	Latencies *hostLatencies
+	// Robots, if set, skips feeds that robots.txt disallows.
+	Robots *robotsChecker
+	// HeadProbe checks whether cached feeds have changed with a HEAD
+	// request before fetching them.
+	HeadProbe bool
+	// Merge fills fields missing from an entry from its duplicates.
+	Merge bool
+	// DedupTitles also drops entries with the same title as a newer one
+	// from the same feed on the same day. See dedupTitles.
+	DedupTitles bool
+	// Limit is the maximum number of entries returned, or 0 for no limit.
+	Limit int
+	// PerFeed is the maximum number of entries from each feed, or 0 for no
+	// limit.
+	PerFeed int
+	// PerCategory is the maximum number of entries from each OPML
+	// category, or 0 for no limit. CategoryLimits overrides it for
+	// particular categories.
+	PerCategory    int
+	CategoryLimits map[string]int
+	// IncludeTags and ExcludeTags filter entries on the categories their
+	// feeds give them. See filterTags.
+	IncludeTags []string
+	ExcludeTags []string
+	// Since, if positive, leaves out entries older than this.
+	Since time.Duration
+	// DBPath is the SQLite database entries are kept in, if any.
+	DBPath string
+	// SeenPath is where the entries output are remembered, if anywhere, so
+	// that those that weren't output last time can be marked New.
+	SeenPath string
+	// DumpDir is where feeds that fail to parse are written, if anywhere.
+	DumpDir string
+
+	// Format is the output format, "html", "atom", "rss", "text", "json" or
+	// "mbox".
+	Format string
+	// Preview, if positive, makes Render write a plain text preview of
+	// that many entries instead.
+	Preview int
+	// Stale, if set, is when the entries being rendered were collected,
+	// because none could be collected this time.
+	Stale time.Time
+	// Pretty indents json output.
+	Pretty bool
+	// Template renders the html output.
+	Template *template.Template
+
+	// Stats counts what the last call to Fetch did.
+	Stats FetchStats
+}
+
+// FetchStats summarises a call to Aggregator.Fetch.
+type FetchStats struct {
+	// Feeds is how many feeds were fetched, or started before the deadline.
+	Feeds   int
+	Fetched int
+	Failed  int
+	// Entries counts every entry parsed, and Duplicates how many of those
+	// were dropped as duplicates of another.
+	Entries    int
+	Duplicates int
+}
+
+// Fetch fetches every feed concurrently and returns their entries, without
+// duplicates, newest first. Feeds that can't be fetched or parsed are logged
+// and left out. If ctx is cancelled, Fetch returns whatever has been collected
+// so far.
+func (a *Aggregator) Fetch(ctx context.Context, feeds []feedSource) []Entry {
+	entrySet := newEntrySet(a.Merge)
+	generators := make(map[string]int)
+	var stats FetchStats
+	// mu guards entrySet, generators and the counts in stats that the
+	// fetching goroutines update.
+	var mu sync.Mutex
+	collect := func(order int, feed Feed) {
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Fetched++
+		stats.Entries += len(feed.Entries)
+		generators[feed.Generator]++
+		for _, entry := range feed.Entries {
+			entry.feedOrder = order
+			entrySet.add(entry)
+		}
+	}
+
+	sem := make(chan struct{}, a.concurrency())
+	var wg sync.WaitGroup
+dispatch:
+	for i, feed := range feeds {
+		slot := &fetchSlot{sem: sem}
+		if slot.acquire(ctx) != nil {
+			break dispatch
+		}
+		stats.Feeds++
+		wg.Add(1)
+		go func(order int, feed feedSource) {
+			defer wg.Done()
+			res := a.fetch(context.WithValue(ctx, slotKey{}, slot), feed)
+			slot.release()
+			if res.Err != nil {
+				// Past the deadline, failures are expected and not
+				// the feed's fault.
+				if ctx.Err() == nil {
+					logFetchError(res.URL, res.Err)
+				}
+				return
+			}
+			collect(order, res.Feed)
+		}(i, feed)
+	}
+
+	wg.Wait()
+	// Feeds abandoned at the deadline count as failures too.
+	stats.Failed = stats.Feeds - stats.Fetched
+	stats.Duplicates = stats.Entries - len(entrySet.entries)
+	a.Stats = stats
+
+	logGenerators(generators)
+
+	if a.DBPath != "" {
+		if err := a.addStored(entrySet, feeds); err != nil {
+			slog.Error("error using database", "path", a.DBPath, "err", err)
+		}
+	}
+
+	entries := entrySet.list()
+	if a.Since > 0 {
+		entries = filterSince(entries, time.Now().Add(-a.Since))
+	}
+
+	sortEntries(entries)
+	if a.DedupTitles {
+		entries = dedupTitles(entries)
+	}
+
+	// Feed and category limits are applied before the overall limit so that
+	// one busy feed or category can't crowd the others out of it.
+	if a.PerFeed > 0 {
+		entries = limitPerFeed(entries, a.PerFeed)
+	}
+	if a.PerCategory > 0 || len(a.CategoryLimits) > 0 {
+		entries = limitPerCategory(entries, a.PerCategory, a.CategoryLimits)
+	}
+
+	if a.Limit > 0 && len(entries) > a.Limit {
+		entries = entries[:a.Limit]
+	}
+
+	if a.SeenPath != "" {
+		a.markSeen(entries)
+	}
+	return entries
+}
+
+// markSeen marks the entries that weren't output last time as New, and
+// remembers these ones for next time. A run that collected nothing, perhaps
+// for want of a connection, doesn't forget what was seen before it.
+func (a *Aggregator) markSeen(entries []Entry) {
+	seen, err := loadSeen(a.SeenPath)
+	if err != nil {
+		slog.Error("error loading seen entries", "path", a.SeenPath, "err", err)
+		return
+	}
+	ids := markNew(entries, seen)
+	if len(entries) == 0 {
+		return
+	}
+	if err := saveSeen(a.SeenPath, ids); err != nil {
+		slog.Error("error saving seen entries", "path", a.SeenPath, "err", err)
+	}
+}
+
+func (a *Aggregator) concurrency() int {
+	if a.Concurrency > 0 {
+		return a.Concurrency
+	}
+	return defaultConcurrency
+}
+
+// sortEntries sorts entries newest first. Undated entries go at the end, since
+// their made up times would otherwise put them above everything else, in feed
+// order. Entries with the same time are kept in OPML and then feed order, so
+// that the same entries always come out in the same order, whatever order they
+// were collected in.
+func sortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch {
+		case a.HasDate != b.HasDate:
+			return a.HasDate
+		case a.HasDate && !a.Time.Equal(b.Time):
+			return a.Time.After(b.Time)
+		default:
+			return listedBefore(a, b)
+		}
+	})
+}
+
+// listedBefore reports whether a comes before b in the order the OPML lists
+// their feeds and the feeds list them, which doesn't depend on when the
+// feeds happened to be fetched.
+func listedBefore(a, b Entry) bool {
+	switch {
+	case a.feedOrder != b.feedOrder:
+		return a.feedOrder < b.feedOrder
+	case a.FeedURL != b.FeedURL:
+		// Entries from the database whose feeds are no longer listed
+		// are all left with a feedOrder of 0.
+		return a.FeedURL < b.FeedURL
+	case a.position != b.position:
+		return a.position < b.position
+	default:
+		return a.Link < b.Link
+	}
+}
+
+// filterSince returns the entries dated after cutoff. Undated entries are
+// kept, since their age is unknown.
+func filterSince(entries []Entry, cutoff time.Time) []Entry {
+	var ret []Entry
+	for _, entry := range entries {
+		if !entry.HasDate || entry.Time.After(cutoff) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// dedupTitles keeps only the newest of the entries, which must already be
+// sorted by sortEntries, that share a feed, title and day. It catches feeds
+// that repeat a post under links that differ only in ways normalizeLink
+// doesn't know about. The day stops a regular post such as "Weekly Roundup"
+// from being merged with the last one, and undated entries are all kept for
+// the same reason.
+func dedupTitles(entries []Entry) []Entry {
+	type key struct{ source, title, day string }
+	seen := make(map[key]bool)
+	var ret []Entry
+	for _, entry := range entries {
+		if entry.HasDate {
+			k := key{entry.SourceTitle, entry.EntryTitle, entry.Time.Local().Format("2006-01-02")}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+		}
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// FeedResult is the outcome of fetching a single feed.
+type FeedResult struct {
+	URL  string
+	Feed Feed
+	// Err is why the feed has nothing to contribute, if it doesn't.
+	Err error
+}
+
+// parseError is returned for feeds that were fetched but couldn't be parsed.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string { return "gathering feed entries: " + e.err.Error() }
+func (e *parseError) Unwrap() error { return e.err }
+
+// fetch fetches and parses a single feed.
+func (a *Aggregator) fetch(ctx context.Context, feed feedSource) FeedResult {
+	url := feed.URL
+	host := hostname(url)
+	// A timeout given for the feed in the OPML is used as it is.
+	timeout := a.Latencies.timeout(host, a.FeedTimeout)
+	if feed.Timeout > 0 {
+		timeout = feed.Timeout
+	} else if timeout != a.FeedTimeout {
+		slog.Debug("allowing longer for slow host", "url", url, "timeout", timeout)
+	}
+	cached, ok := a.Cache.get(url)
+	fresh := ok && !a.Force && time.Now().Before(cached.Expires)
+	if !fresh && a.Robots != nil && !a.Robots.allowed(ctx, url) {
+		return FeedResult{URL: url, Err: errDisallowed}
+	}
+	var res fetched
+	var err error
+	if !fresh && a.HeadProbe && ok && cached.Validators != (validators{}) {
+		if expires, unchanged := probeFeed(ctx, a.Client, url, timeout, cached.Validators, feed.Auth); unchanged {
+			res, err = fetched{validators: cached.Validators, expires: expires}, errNotModified
+		}
+	}
+	if !fresh && err == nil {
+		res, err = fetchWithRetries(ctx, a.Client, url, timeout, cached.Validators, feed.Auth)
+		// Failures say nothing about how long the host usually takes.
+		if err == nil || errors.Is(err, errNotModified) {
+			a.Latencies.observe(host, res.elapsed)
+		}
+	}
+	var parsedFeed Feed
+	switch {
+	case fresh:
+		slog.Debug("feed still fresh, reusing cached entries", "url", url, "expires", cached.Expires)
+		parsedFeed = cached.feed()
+	case ctx.Err() != nil:
+		return FeedResult{URL: url, Err: ctx.Err()}
+	case errors.Is(err, errNotModified):
+		slog.Debug("feed not modified, reusing cached entries", "url", url)
+		parsedFeed = cached.feed()
+		cached.Expires = res.expires
+		a.Cache.put(url, cached)
+	case err != nil:
+		return FeedResult{URL: url, Err: err}
+	default:
+		// Pages are told apart before parsing, as HTML rarely gets far
+		// enough as XML to be recognised as not being a feed. Failing
+		// that, anything served as HTML that won't parse is taken for
+		// a page.
+		page := isHTMLDocument(res.body)
+		if !page {
+			parsedFeed, err = parseFeed(res.url, res.body)
+			page = err != nil && isHTML(res.contentType)
+		}
+		if page {
+			// The entries came from some other URL, so the validators
+			// we have don't apply to them.
+			res.validators = validators{}
+			parsedFeed, err = discoverAndParse(ctx, a.Client, res, timeout, feed.Auth)
+		}
+		if err != nil {
+			if a.DumpDir != "" {
+				if err := dumpFeed(a.DumpDir, url, res.body); err != nil {
+					slog.Error("error dumping feed", "url", url, "err", err)
+				}
+			}
+			return FeedResult{URL: url, Err: &parseError{err: err}}
+		}
+		// Without validators or an expiry time there's no way to avoid
+		// fetching the whole feed next time, so there's no point keeping
+		// the entries.
+		if res.validators.ETag != "" || res.validators.LastModified != "" || !res.expires.IsZero() {
+			a.Cache.put(url, cachedFeed{
+				Validators: res.validators,
+				Title:      parsedFeed.Title,
+				Generator:  parsedFeed.Generator,
+				SelfURL:    parsedFeed.SelfURL,
+				Hub:        parsedFeed.Hub,
+				Entries:    parsedFeed.Entries,
+				Expires:    res.expires,
+			})
+		}
+	}
+	for _, err := range parsedFeed.Skipped {
+		slog.Warn("skipping entry", "url", url, "err", err)
+	}
+	for i := range parsedFeed.Entries {
+		parsedFeed.Entries[i].position = i
+		parsedFeed.Entries[i].FeedURL = url
+		parsedFeed.Entries[i].Category = feed.Category
+		if parsedFeed.Entries[i].SourceTitle == "" {
+			parsedFeed.Entries[i].SourceTitle = hostname(url)
+		}
+	}
+	if len(a.IncludeTags) > 0 || len(a.ExcludeTags) > 0 {
+		parsedFeed.Entries = filterTags(parsedFeed.Entries, a.IncludeTags, a.ExcludeTags)
+	}
+	if a.Resolver != nil {
+		for i := range parsedFeed.Entries {
+			parsedFeed.Entries[i].resolved = a.Resolver.resolve(ctx, parsedFeed.Entries[i].Link)
+		}
+	}
+	slog.Debug("fetched feed", "url", url, "entries", len(parsedFeed.Entries), "generator", parsedFeed.Generator, "self", parsedFeed.SelfURL)
+	return FeedResult{URL: url, Feed: parsedFeed}
+}
+
+// addStored saves the entries collected this run to the database, then adds
+// back any stored entries that the feeds no longer serve.
+func (a *Aggregator) addStored(entrySet *entrySet, feeds []feedSource) error {
+	db, err := openStore(a.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Save(entrySet.list()); err != nil {
+		return err
+	}
+	stored, err := db.Recent(a.Limit)
+	if err != nil {
+		return err
+	}
+	// Categories come from the OPML rather than the feed, so they aren't
+	// stored and may have changed since.
+	categories := make(map[string][]string, len(feeds))
+	order := make(map[string]int, len(feeds))
+	for i, feed := range feeds {
+		categories[feed.URL] = feed.Category
+		order[feed.URL] = i
+	}
+	// Stored entries were filtered when they were fetched, but perhaps
+	// by different tags.
+	if len(a.IncludeTags) > 0 || len(a.ExcludeTags) > 0 {
+		stored = filterTags(stored, a.IncludeTags, a.ExcludeTags)
+	}
+	for _, entry := range stored {
+		if entrySet.has(entry) {
+			continue
+		}
+		entry.Category = categories[entry.FeedURL]
+		entry.feedOrder = order[entry.FeedURL]
+		entrySet.add(entry)
+	}
+	return nil
+}
+
+// ExportOPML writes feeds to w as a flat OPML document, with duplicate URLs
+// removed. Each feed is fetched to find its title, falling back to the URL if
+// that fails.
+func (a *Aggregator) ExportOPML(ctx context.Context, w io.Writer, feeds []feedSource) error {
+	unique := uniqueFeeds(feeds)
+	doc := opml{Version: "2.0", Title: "Eris Feeds", Outlines: make([]outline, len(unique))}
+	sem := make(chan struct{}, a.concurrency())
+	var wg sync.WaitGroup
+	for i, feed := range unique {
+		wg.Add(1)
+		go func(i int, feed feedSource) {
+			defer wg.Done()
+			text := feed.URL
+			sem <- struct{}{}
+			res := a.fetch(ctx, feed)
+			<-sem
+			switch {
+			case res.Err != nil:
+				if ctx.Err() == nil {
+					logFetchError(res.URL, res.Err)
+				}
+			case res.Feed.Title != "":
+				text = res.Feed.Title
+			}
+			doc.Outlines[i] = outline{Type: "rss", Text: text, XmlUrl: feed.URL}
+		}(i, feed)
+	}
+	wg.Wait()
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Validate fetches every feed and writes a line to w for each saying whether
+// it worked, and if not why not. Feeds with entries that had to be skipped
+// still count as working. It returns the exit status, which is non-zero
+// if any feed failed.
+func (a *Aggregator) Validate(ctx context.Context, w io.Writer, feeds []feedSource) int {
+	status := 0
+	for _, res := range a.fetchAll(ctx, feeds) {
+		if res.Err != nil {
+			status = 1
+			fmt.Fprintf(w, "FAIL %s: %s\n", res.URL, describeFetchError(res.Err))
+			continue
+		}
+		skipped := ""
+		if n := len(res.Feed.Skipped); n > 0 {
+			// The reasons have already been logged.
+			skipped = fmt.Sprintf(", %d skipped", n)
+		}
+		fmt.Fprintf(w, "OK   %s: %d entries%s\n", res.URL, len(res.Feed.Entries), skipped)
+	}
+	return status
+}
+
+// stale describes when stale entries were collected, or returns "" if they
+// aren't stale. It is available to html templates as stale.
+func (a *Aggregator) stale() string {
+	if a == nil || a.Stale.IsZero() {
+		return ""
+	}
+	return a.Stale.Local().Format("2 January 2006 15:04")
+}
+
+// ReportHubs fetches every feed and writes a line to w for each that
+// advertises a WebSub hub, giving the hub.
+func (a *Aggregator) ReportHubs(ctx context.Context, w io.Writer, feeds []feedSource) error {
+	results := a.fetchAll(ctx, feeds)
+	hubs := 0
+	for _, res := range results {
+		if res.Err != nil {
+			if ctx.Err() == nil {
+				logFetchError(res.URL, res.Err)
+			}
+			continue
+		}
+		if res.Feed.Hub == "" {
+			continue
+		}
+		hubs++
+		if _, err := fmt.Fprintf(w, "%s: %s\n", res.URL, res.Feed.Hub); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d of %d feeds advertise a hub\n", hubs, len(results))
+	return err
+}
+
+// fetchAll fetches every feed, returning the results in the same order.
+func (a *Aggregator) fetchAll(ctx context.Context, feeds []feedSource) []FeedResult {
+	// Callers report on the feeds as they are now, so each one has to be
+	// asked, however fresh the cache says it is.
+	live := *a
+	live.Force = true
+	results := make([]FeedResult, len(feeds))
+	sem := make(chan struct{}, a.concurrency())
+	var wg sync.WaitGroup
+	for i, feed := range feeds {
+		wg.Add(1)
+		go func(i int, feed feedSource) {
+			defer wg.Done()
+			sem <- struct{}{}
+			results[i] = live.fetch(ctx, feed)
+			<-sem
+		}(i, feed)
+	}
+	wg.Wait()
+	return results
+}
+
+// Render writes entries to w in the configured output format.
+func (a *Aggregator) Render(w io.Writer, entries []Entry) error {
+	if a.Preview > 0 {
+		if err := writePreview(w, entries, a.Preview); err != nil {
+			return fmt.Errorf("writing preview: %w", err)
+		}
+		return nil
+	}
+	switch a.Format {
+	case "atom":
+		if err := writeAtom(w, entries); err != nil {
+			return fmt.Errorf("writing atom feed: %w", err)
+		}
+	case "rss":
+		if err := writeRSS(w, entries); err != nil {
+			return fmt.Errorf("writing rss feed: %w", err)
+		}
+	case "text":
+		if stale := a.stale(); stale != "" {
+			if _, err := fmt.Fprintf(w, "No feeds could be fetched, so these entries are from %s.\n\n", stale); err != nil {
+				return fmt.Errorf("writing text: %w", err)
+			}
+		}
+		if err := writeText(w, entries); err != nil {
+			return fmt.Errorf("writing text: %w", err)
+		}
+	case "json":
+		if err := writeJSON(w, entries, a.Pretty); err != nil {
+			return fmt.Errorf("writing json: %w", err)
+		}
+	case "mbox":
+		if err := writeMbox(w, entries); err != nil {
+			return fmt.Errorf("writing mbox: %w", err)
+		}
+	default:
+		if err := a.Template.Execute(w, groupByCategory(entries)); err != nil {
+			return fmt.Errorf("executing html template: %w", err)
+		}
+	}
+	return nil
+}
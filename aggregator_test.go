@@ -0,0 +1,326 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestFetchDiscoversFeedFromPage(t *testing.T) {
+	const page = `<!DOCTYPE html>
+<html><head><title>Blog</title>
+<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+<script>if (a < b && c) {}</script>
+</head><body>Hello</body></html>`
+	for _, contentType := range []string{"text/html; charset=utf-8", "application/octet-stream"} {
+		t.Run(contentType, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/feed.xml" {
+					w.Write([]byte(testFeed))
+					return
+				}
+				w.Header().Set("Content-Type", contentType)
+				w.Write([]byte(page))
+			}))
+			defer srv.Close()
+			a := &Aggregator{Client: srv.Client(), FeedTimeout: time.Second}
+
+			res := a.fetch(context.Background(), feedSource{URL: srv.URL + "/"})
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if len(res.Feed.Entries) != 1 || res.Feed.Entries[0].EntryTitle != "One" {
+				t.Errorf("got entries %+v, want the one from the advertised feed", res.Feed.Entries)
+			}
+		})
+	}
+}
+
+func TestValidateIgnoresFreshCache(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL + "/feed.xml"
+	client := srv.Client()
+	srv.Close()
+	cache := &feedCache{feeds: map[string]cachedFeed{
+		url: {Entries: []Entry{{EntryTitle: "One"}}, Expires: time.Now().Add(time.Hour)},
+	}}
+	a := &Aggregator{Client: client, Cache: cache, FeedTimeout: time.Second}
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 0
+
+	var out bytes.Buffer
+	if status := a.Validate(context.Background(), &out, []feedSource{{URL: url}}); status != 1 {
+		t.Errorf("got status %d, want 1 as the server is gone", status)
+	}
+	if !strings.HasPrefix(out.String(), "FAIL ") {
+		t.Errorf("got %q, want a failure", out.String())
+	}
+}
+
+func TestFetchFeedTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 0
+	a := &Aggregator{Client: srv.Client(), FeedTimeout: 50 * time.Millisecond}
+
+	// The feed's own timeout applies rather than FeedTimeout, in either
+	// direction.
+	if res := a.fetch(context.Background(), feedSource{URL: srv.URL, Timeout: time.Second}); res.Err != nil {
+		t.Errorf("with a longer timeout: %v", res.Err)
+	}
+	a.FeedTimeout = time.Second
+	res := a.fetch(context.Background(), feedSource{URL: srv.URL, Timeout: 50 * time.Millisecond})
+	if !errors.Is(res.Err, context.DeadlineExceeded) {
+		t.Errorf("with a shorter timeout got %v, want the deadline to be exceeded", res.Err)
+	}
+}
+
+// rssFeed returns an RSS feed with an item for each of posts, linking to
+// http://example.com/n and dated n hours into 2024.
+func rssFeed(title string, posts ...int) string {
+	var items strings.Builder
+	for _, n := range posts {
+		date := time.Date(2024, 1, 1, n, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+		fmt.Fprintf(&items, "<item><title>Post %d</title><link>http://example.com/%d</link><pubDate>%s</pubDate></item>\n", n, n, date)
+	}
+	return fmt.Sprintf("<rss version=\"2.0\"><channel><title>%s</title>\n%s</channel></rss>", title, items.String())
+}
+
+func TestFetchCollectsAndDeduplicates(t *testing.T) {
+	feeds := map[string]string{
+		"/a": rssFeed("A", 1, 2),
+		"/b": rssFeed("B", 2, 3),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		feed, ok := feeds[r.URL.Path]
+		if !ok {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 0
+	a := &Aggregator{Client: srv.Client(), FeedTimeout: time.Second}
+
+	entries := a.Fetch(context.Background(), []feedSource{{URL: srv.URL + "/a"}, {URL: srv.URL + "/b"}, {URL: srv.URL + "/c"}})
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.EntryTitle+" from "+entry.SourceTitle)
+	}
+	// Post 2 is in both feeds, and kept from the one listed first.
+	want := []string{"Post 3 from B", "Post 2 from A", "Post 1 from A"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	wantStats := FetchStats{Feeds: 3, Fetched: 2, Failed: 1, Entries: 4, Duplicates: 1}
+	if a.Stats != wantStats {
+		t.Errorf("got stats %+v, want %+v", a.Stats, wantStats)
+	}
+}
+
+func TestFetchManyConcurrently(t *testing.T) {
+	// Feed n lists posts n to n+4, so most posts turn up in several feeds on
+	// different servers at once.
+	const perServer, servers = 10, 4
+	var feeds []feedSource
+	for s := 0; s < servers; s++ {
+		first := s * perServer
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var n int
+			fmt.Sscanf(r.URL.Path, "/%d", &n)
+			w.Write([]byte(rssFeed(fmt.Sprint("Feed ", n), n, n+1, n+2, n+3, n+4)))
+		}))
+		defer srv.Close()
+		for n := first; n < first+perServer; n++ {
+			feeds = append(feeds, feedSource{URL: fmt.Sprintf("%s/%d", srv.URL, n)})
+		}
+	}
+	a := &Aggregator{Client: http.DefaultClient, FeedTimeout: 5 * time.Second, Concurrency: 16}
+
+	entries := a.Fetch(context.Background(), feeds)
+	const total, unique = servers * perServer * 5, servers*perServer + 4
+	if len(entries) != unique {
+		t.Errorf("got %d entries, want %d", len(entries), unique)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[entry.Link] {
+			t.Errorf("got %s twice", entry.Link)
+		}
+		seen[entry.Link] = true
+		// Each post is kept from the first feed listing it.
+		var post, feed int
+		fmt.Sscanf(entry.EntryTitle, "Post %d", &post)
+		fmt.Sscanf(entry.SourceTitle, "Feed %d", &feed)
+		if want := max(post-4, 0); feed != want {
+			t.Errorf("got post %d from feed %d, want it from feed %d", post, feed, want)
+		}
+	}
+	wantStats := FetchStats{Feeds: len(feeds), Fetched: len(feeds), Entries: total, Duplicates: total - unique}
+	if a.Stats != wantStats {
+		t.Errorf("got stats %+v, want %+v", a.Stats, wantStats)
+	}
+}
+
+func TestFetchRateLimitedHostDoesNotHoldSlots(t *testing.T) {
+	start := time.Now()
+	var otherHost atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Host, "localhost:") {
+			otherHost.Store(int64(time.Since(start)))
+		}
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+	// The same server under another name gets a rate limit of its own.
+	other := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, rate.Every(500*time.Millisecond), 1)}
+	a := &Aggregator{Client: client, FeedTimeout: 5 * time.Second, Concurrency: 2}
+
+	a.Fetch(context.Background(), []feedSource{{URL: srv.URL + "/1"}, {URL: srv.URL + "/2"}, {URL: srv.URL + "/3"}, {URL: other + "/1"}})
+	if a.Stats.Fetched != 4 {
+		t.Errorf("got stats %+v, want all four feeds fetched", a.Stats)
+	}
+	// The other host shouldn't have to wait for the slots to come free of
+	// feeds waiting for their turn on the first.
+	if got := time.Duration(otherHost.Load()); got > 250*time.Millisecond {
+		t.Errorf("other host was first requested after %v", got)
+	}
+}
+
+func TestFetchConcurrencyLimit(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+	a := &Aggregator{Client: srv.Client(), FeedTimeout: time.Second, Concurrency: 3}
+
+	var feeds []feedSource
+	for i := 0; i < 20; i++ {
+		feeds = append(feeds, feedSource{URL: fmt.Sprintf("%s/%d", srv.URL, i)})
+	}
+	a.Fetch(context.Background(), feeds)
+	if a.Stats.Fetched != len(feeds) {
+		t.Errorf("fetched %d feeds, want %d", a.Stats.Fetched, len(feeds))
+	}
+	if got := peak.Load(); got > 3 {
+		t.Errorf("%d requests were in flight at once, want at most 3", got)
+	} else if got < 2 {
+		t.Errorf("only %d request was in flight at once, so feeds weren't fetched concurrently", got)
+	}
+}
+
+func TestFetchSendsCredentials(t *testing.T) {
+	const password = "s3cret-pa55"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "me" || pass != password {
+			http.Error(w, "who are you?", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 0
+	var logs bytes.Buffer
+	defer func(l *slog.Logger) { slog.SetDefault(l) }(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	u := strings.Replace(srv.URL, "http://", "http://me:"+password+"@", 1)
+	doc := `<opml><body>
+<outline xmlUrl="` + u + `/in-url"/>
+<outline xmlUrl="` + srv.URL + `/in-attributes" user="me" password="` + password + `"/>
+<outline xmlUrl="` + u + `/wrong" password="wrong"/>
+</body></opml>`
+	feeds, err := parseOPMLBytes([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, feed := range feeds {
+		if strings.Contains(feed.URL, password) {
+			t.Errorf("URL %q still has the password in it", feed.URL)
+		}
+	}
+	a := &Aggregator{Client: srv.Client(), FeedTimeout: time.Second}
+	a.Fetch(context.Background(), feeds)
+	if a.Stats.Fetched != 2 || a.Stats.Failed != 1 {
+		t.Errorf("got stats %+v, want the two feeds with the right password fetched", a.Stats)
+	}
+	if strings.Contains(logs.String(), password) {
+		t.Errorf("the password was logged:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "/wrong") {
+		t.Errorf("the failure wasn't logged:\n%s", logs.String())
+	}
+}
+
+func TestSortEntriesIsDeterministic(t *testing.T) {
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Link: "a1", FeedURL: "http://a.example/", feedOrder: 1, position: 0, Time: noon, HasDate: true},
+		{Link: "a2", FeedURL: "http://a.example/", feedOrder: 1, position: 1, Time: noon, HasDate: true},
+		{Link: "b1", FeedURL: "http://b.example/", feedOrder: 2, position: 0, Time: noon, HasDate: true},
+		{Link: "newer", FeedURL: "http://b.example/", feedOrder: 2, position: 1, Time: noon.Add(time.Hour), HasDate: true},
+		// Stored entries whose feeds are no longer listed have no feedOrder.
+		{Link: "stored-x", FeedURL: "http://x.example/", Time: noon, HasDate: true},
+		{Link: "stored-y", FeedURL: "http://y.example/", Time: noon, HasDate: true},
+		{Link: "undated2", FeedURL: "http://a.example/", feedOrder: 1, position: 3},
+		{Link: "undated1", FeedURL: "http://a.example/", feedOrder: 1, position: 2},
+	}
+	want := []string{"newer", "stored-x", "stored-y", "a1", "a2", "b1", "undated1", "undated2"}
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 20; run++ {
+		shuffled := append([]Entry(nil), entries...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		sortEntries(shuffled)
+		var got []string
+		for _, entry := range shuffled {
+			got = append(got, entry.Link)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: got %q, want %q", run, got, want)
+		}
+	}
+}
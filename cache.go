@@ -0,0 +1,196 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// validators are the response headers a server can use to tell us a feed
+// hasn't changed since we last fetched it.
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// cachedFeed is what is remembered about a feed between runs so that it can
+// be reused when the server responds 304 Not Modified.
+type cachedFeed struct {
+	Validators validators `json:"validators"`
+	Title      string     `json:"title,omitempty"`
+	Generator  string     `json:"generator,omitempty"`
+	SelfURL    string     `json:"self_url,omitempty"`
+	Hub        string     `json:"hub,omitempty"`
+	Entries    []Entry    `json:"entries"`
+	// Expires is when the feed should next be fetched, according to its
+	// caching headers.
+	Expires time.Time `json:"expires"`
+}
+
+func (f cachedFeed) feed() Feed {
+	return Feed{Title: f.Title, SelfURL: f.SelfURL, Hub: f.Hub, Generator: f.Generator, Entries: f.Entries}
+}
+
+// feedCache is the on-disk cache of feeds, keyed by URL. A nil *feedCache is
+// valid and caches nothing.
+type feedCache struct {
+	mu    sync.Mutex
+	feeds map[string]cachedFeed
+}
+
+// defaultCachePath returns $XDG_CACHE_HOME/eris/name, or the platform
+// equivalent.
+func defaultCachePath(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "eris", name)
+}
+
+// loadCache reads the cache at path. A missing file is not an error, it just
+// gives an empty cache.
+func loadCache(path string) (*feedCache, error) {
+	c := &feedCache{feeds: make(map[string]cachedFeed)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.feeds); err != nil {
+		return nil, fmt.Errorf("decoding cache: %w", err)
+	}
+	return c, nil
+}
+
+func (c *feedCache) get(url string) (cachedFeed, bool) {
+	if c == nil {
+		return cachedFeed{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	feed, ok := c.feeds[url]
+	return feed, ok
+}
+
+func (c *feedCache) put(url string, feed cachedFeed) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.feeds[url] = feed
+}
+
+// save writes the cache to path, replacing the previous file only once the
+// new one is completely written.
+func (c *feedCache) save(path string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c.feeds)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("encoding cache: %w", err)
+	}
+	return writeCacheFile(path, data)
+}
+
+// lastOutput is the entries output by the last run that found any, kept to
+// fall back on when a run finds none.
+type lastOutput struct {
+	Time    time.Time `json:"time"`
+	Entries []Entry   `json:"entries"`
+}
+
+// loadOutput reads the entries saved at path by saveOutput. A missing file
+// gives no entries.
+func loadOutput(path string) (lastOutput, error) {
+	var last lastOutput
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return last, nil
+	}
+	if err != nil {
+		return last, fmt.Errorf("reading output cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &last); err != nil {
+		return last, fmt.Errorf("decoding output cache: %w", err)
+	}
+	return last, nil
+}
+
+func saveOutput(path string, entries []Entry) error {
+	data, err := json.Marshal(lastOutput{Time: time.Now(), Entries: entries})
+	if err != nil {
+		return fmt.Errorf("encoding output cache: %w", err)
+	}
+	return writeCacheFile(path, data)
+}
+
+// loadSeen reads the entry identities saved at path by saveSeen. A missing
+// file gives nil, rather than an empty set, so that the first run can be told
+// apart from one after a run that output nothing.
+func loadSeen(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading seen entries: %w", err)
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("decoding seen entries: %w", err)
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return seen, nil
+}
+
+func saveSeen(path string, ids []string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return fmt.Errorf("encoding seen entries: %w", err)
+	}
+	return writeCacheFile(path, data)
+}
+
+// writeCacheFile writes data to path, replacing the previous file only once
+// the new one is completely written.
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating cache directory: %w", err)
+	}
+	err := writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("writing cache file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// configSetting is one name = value line of a config file.
+type configSetting struct {
+	line  int
+	name  string
+	value string
+}
+
+// parseConfig reads a config file of name = value lines, where each name is
+// a flag without its leading dash. Blank lines and lines starting with # are
+// ignored. Values may be quoted to keep surrounding spaces.
+func parseConfig(r io.Reader) ([]configSetting, error) {
+	var settings []configSetting
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: %q is not of the form name = value", lineNo, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		settings = append(settings, configSetting{line: lineNo, name: strings.TrimPrefix(strings.TrimSpace(name), "-"), value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// applyConfig sets the flags named in settings, except for those already set
+// on the command line, which take precedence. Repeatable flags can be given
+// on several lines, but the command line still replaces all of them.
+func applyConfig(fs *flag.FlagSet, settings []configSetting) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, setting := range settings {
+		if setting.name == "config" {
+			return fmt.Errorf("line %d: config files can't include other config files", setting.line)
+		}
+		if fs.Lookup(setting.name) == nil {
+			return fmt.Errorf("line %d: unknown option %q", setting.line, setting.name)
+		}
+		if explicit[setting.name] {
+			continue
+		}
+		if err := fs.Set(setting.name, setting.value); err != nil {
+			return fmt.Errorf("line %d: %s: %w", setting.line, setting.name, err)
+		}
+	}
+	return nil
+}
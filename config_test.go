@@ -0,0 +1,94 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	settings, err := parseConfig(strings.NewReader(`# Options for cron.
+limit = 20
+
+-format=atom
+user-agent = " eris (cron) "
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configSetting{
+		{line: 2, name: "limit", value: "20"},
+		{line: 4, name: "format", value: "atom"},
+		{line: 5, name: "user-agent", value: " eris (cron) "},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("got settings %+v, want %+v", settings, want)
+	}
+	if _, err := parseConfig(strings.NewReader("limit 20")); err == nil {
+		t.Error("expected an error for a line without =")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs := flag.NewFlagSet("eris", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	limit := fs.Int("limit", 10, "")
+	timeout := fs.Duration("timeout", time.Minute, "")
+	format := fs.String("format", "html", "")
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"-limit", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseConfig(strings.NewReader("limit = 20\ntimeout = 30s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, settings); err != nil {
+		t.Fatal(err)
+	}
+	if *limit != 5 {
+		t.Errorf("got limit %d, want the command line's 5 rather than the config's 20", *limit)
+	}
+	if *timeout != 30*time.Second {
+		t.Errorf("got timeout %v, want the config's 30s", *timeout)
+	}
+	if *format != "html" {
+		t.Errorf("got format %q, want the default to be left alone", *format)
+	}
+
+	for _, test := range []struct {
+		config, want string
+	}{
+		{"colour = blue", `line 1: unknown option "colour"`},
+		{"\nconfig = other.conf", "line 2: config files can't include other config files"},
+		{"timeout = soon", "line 1: timeout: "},
+	} {
+		fs := flag.NewFlagSet("eris", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Duration("timeout", time.Minute, "")
+		fs.String("config", "", "")
+		settings, err := parseConfig(strings.NewReader(test.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfig(fs, settings); err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("applying %q: got error %v, want %q", test.config, err, test.want)
+		}
+	}
+}
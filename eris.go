@@ -15,48 +15,433 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"golang.org/x/net/html"
 	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/time/rate"
 )
 
 const (
-	// HTTP client connection timeout. 15 seconds is an arbitrary number to try
-	// to limit the amount of time wasted on servers with poor connections.
+	// Default HTTP client connection timeout. 15 seconds is an arbitrary number
+	// to try to limit the amount of time wasted on servers with poor
+	// connections. Individual feeds can override it from the OPML file.
 	clientTimeout = 15 * time.Second
-	// Maximum number of concurrent connections allowed per host. Lots of feeds
-	// (especially podcasts) use the same host, and so we can get forced resets
-	// if we try to connect too fast.
+	// Default maximum number of concurrent connections allowed per host.
+	// Lots of feeds (especially podcasts) use the same host, and so we can
+	// get forced resets if we try to connect too fast.
 	connsPerHost = 20
-	// Maximum number of entries to include in the HTML output.
+	// Default number of requests per second made to any one host, and how
+	// many can go at once after a quiet spell. Connection limits alone don't
+	// stop a host with many feeds being hit in a quick burst.
+	hostRate  = 2
+	hostBurst = 4
+	// Delay before the first retry of a failed fetch, doubling for each
+	// subsequent retry.
+	retryBackoff = 500 * time.Millisecond
+	// Longest we're prepared to wait when a server asks us to come back later
+	// with Retry-After, so that one throttled feed can't stall the whole run.
+	maxRetryAfter = 60 * time.Second
+	// Accept header for feed requests. Some servers send an HTML page to
+	// clients that don't ask for a feed specifically.
+	feedAccept = "application/atom+xml, application/rss+xml, application/feed+json, application/xml;q=0.9, */*;q=0.8"
+	// User-Agent sent when none is given with -user-agent.
+	defaultUserAgent = "eris (https://github.com/admacleod/eris)"
+	// Default largest feed body we're prepared to read, so that a server
+	// streaming something huge can't exhaust memory.
+	defaultMaxBody = 10 << 20
+	// Default maximum number of feeds fetched at once. Without a limit, a
+	// long OPML file opens a socket for every feed at the same time.
+	defaultConcurrency = 50
+	// Default maximum number of entries to include in the output.
 	maxEntries = 250
+	// Maximum number of concurrent HEAD requests used to resolve entry links.
+	// Resolution is an extra request per entry, so keep it well below the
+	// per-host connection limit.
+	resolveConns = 10
+	// Number of runes an entry summary is cut down to.
+	summaryLength = 200
 )
 
 const (
 	feedTmpl = `<!doctype html>
-<meta charset="utf-8">
+<html lang="{{lang}}">
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
 <meta name="viewport" content="width=device-width, initial-scale=1">
 <title>Eris Feeds</title>
-{{range .}}<p><a href="{{.Link}}">{{.EntryTitle}}</a></p>
+{{with stale}}<p><strong>No feeds could be fetched, so these entries are from {{.}}.</strong></p>
+{{end -}}
+{{range .}}<section>
+<h2>{{.Category}}</h2>
+{{range .Days}}<h3>{{.Date}}</h3>
+{{range .Entries}}<p>{{if .New}}<mark>new</mark> {{end}}{{with .FaviconURL}}<img src="{{.}}" alt="" width="16" height="16"> {{end}}{{with .ImageURL}}<img src="{{.}}" alt="" width="48" height="48"> {{end}}<a href="{{.Link}}">{{.EntryTitle}}</a>{{with .Author}} by {{.}}{{end}} <small>({{.SourceTitle}}{{with .Enclosure.URL}}, <a href="{{.}}">media</a>{{end}}{{with .PlayTime}}, {{.}}{{end}}{{with .Size}}, {{.}}{{end}})</small>{{with .Summary}}<br>{{.}}{{end}}</p>
+{{end}}{{end}}</section>
 {{end -}}`
 )
 
+// stringsFlag is a flag.Value that collects every occurrence of a repeatable
+// flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var (
+	opmlCategories stringsFlag
+	categoryLimits stringsFlag
+	includeTags    stringsFlag
+	excludeTags    stringsFlag
+	stripParams    stringsFlag
+	includeFeeds   stringsFlag
+	excludeFeeds   stringsFlag
+)
+
+func init() {
+	flag.Var(&opmlCategories, "opml-category", "only fetch feeds under the top-level OPML outline with this text; may be repeated")
+	flag.Var(&categoryLimits, "category-limit", "override -per-category for one top-level category, as `name=n`; may be repeated")
+	flag.Var(&includeTags, "include-tag", "only include entries the feed gives this category or tag; may be repeated")
+	flag.Var(&stripParams, "strip-param", "ignore this query parameter, or any starting with it if it ends in *, when deduplicating links; may be repeated")
+	flag.Var(&excludeTags, "exclude-tag", "leave out entries the feed gives this category or tag; may be repeated")
+	flag.Var(&includeFeeds, "include-feed", "only fetch feeds whose URLs contain this text, or match it if it has * or ? wildcards; may be repeated")
+	flag.Var(&excludeFeeds, "exclude-feed", "don't fetch feeds whose URLs contain this text, or match it if it has * or ? wildcards; applied after -include-feed; may be repeated")
+}
+
+var (
+	http1Only       = flag.Bool("http1-only", false, "disable HTTP/2; can fix feeds behind servers that return mysteriously empty bodies over HTTP/2")
+	verbose         = flag.Bool("v", false, "enable verbose logging; the same as -log-level debug")
+	logLevel        = flag.String("log-level", "info", "log messages at `level` and above: debug, info, warn or error")
+	preview         = flag.Int("preview", 0, "print the newest `n` entries as plain text instead of HTML")
+	dumpDir         = flag.String("dump-entries-on-error", "", "write the raw body and parsed node tree of any feed that fails to parse to files in `dir`")
+	maxRedirects    = flag.Int("max-redirects", 10, "give up on a feed after following `n` redirects")
+	validateURL     = flag.String("validate-feed", "", "fetch the single feed at `url`, report problems with it and exit")
+	perCategory     = flag.Int("per-category", 0, "keep at most `n` entries from each top-level OPML category; 0 means no limit")
+	connectTimeout  = flag.Duration("connect-timeout", 0, "give up connecting to a host after `duration`; 0 leaves only the overall per-feed timeout")
+	mergeFields     = flag.Bool("merge-fields", false, "combine entries sharing a GUID across feeds field by field instead of keeping only one")
+	cachePath       = flag.String("cache", defaultCachePath("cache.json"), "remember ETag and Last-Modified headers in `file` to make fetches conditional; empty disables caching")
+	format          = flag.String("format", "html", "output `format`, one of html, atom, rss, text, json or mbox")
+	userAgent       = flag.String("user-agent", "", "send `agent` as the User-Agent header instead of the default")
+	from            = flag.String("from", "", "send a From header with this contact `address`")
+	retries         = flag.Int("retries", 2, "retry a feed up to `n` times after network errors or 5xx responses")
+	limit           = flag.Int("limit", maxEntries, "include at most `n` entries in the output; 0 means no limit")
+	feedTimeout     = flag.Duration("feed-timeout", clientTimeout, "give up on a feed after `duration`, unless the OPML overrides it")
+	deadline        = flag.Duration("deadline", 0, "stop fetching after `duration` and output whatever has been collected; 0 means no deadline")
+	dbPath          = flag.String("db", "", "keep entries in the SQLite database at `file` so they outlive their feeds")
+	exportOPML      = flag.Bool("export-opml", false, "write the feeds in the OPML file as a flat, deduplicated OPML document titled from each feed, instead of fetching entries")
+	maxBody         = flag.Int64("max-body", defaultMaxBody, "skip any feed whose body is larger than `bytes`, after decompression")
+	since           = flag.Duration("since", 0, "leave out entries older than `duration`; 0 means no limit")
+	templatePath    = flag.String("template", "", "render the html output with the Go html/template in `file` instead of the built-in one")
+	concurrency     = flag.Int("concurrency", defaultConcurrency, "fetch at most `n` feeds at once")
+	pretty          = flag.Bool("pretty", false, "indent json output")
+	validateAll     = flag.Bool("validate", false, "fetch every feed in the OPML file, report which work and exit, with a non-zero status if any failed")
+	outputCache     = flag.String("output-cache", defaultCachePath("output.json"), "keep the entries output in `file`, to output again, marked as stale, if a run finds none; empty disables this")
+	force           = flag.Bool("force", false, "fetch every feed, even those whose Cache-Control or Expires headers say the cached copy is still fresh")
+	maxConnsPerHost = flag.Int("conns-per-host", connsPerHost, "open at most `n` connections to any one host; 0 means no limit")
+	hostLimitsPath  = flag.String("host-limits", "", "read lower per-host request limits from `file`, one host=n pair per line")
+	reportHubs      = flag.Bool("report-hubs", false, "fetch every feed in the OPML file, list those advertising a WebSub hub and exit")
+	outputPath      = flag.String("output", "", "write the output to `file`, replacing it only once complete, instead of to stdout")
+	requestRate     = flag.Float64("rate", hostRate, "make at most `n` requests per second to any one host; 0 means no limit")
+	listFeeds       = flag.Bool("list-feeds", false, "print the URL of every feed found in the OPML file and selected by -opml-category, -include-feed and -exclude-feed, one per line, and exit without fetching")
+	dedupTitlesFlag = flag.Bool("dedup-titles", false, "also drop entries with the same title as a newer entry from the same feed on the same day")
+	lang            = flag.String("lang", "en", "declare the html output to be in language `tag`")
+	showStats       = flag.Bool("stats", false, "print a one line summary of the run to stderr when done")
+	headProbe       = flag.Bool("head-probe", false, "check whether cached feeds have changed with a HEAD request before fetching them in full")
+	proxyURL        = flag.String("proxy", "", "send every request through the proxy at `url` instead of any given by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	perFeedLimit    = flag.Int("per-feed-limit", 0, "keep at most `n` of the newest entries from each feed; 0 means no limit")
+	favicons        = flag.String("favicons", "site", "show icons next to entries from `service`: site for each site's own /favicon.ico, duckduckgo, google or none")
+	configPath      = flag.String("config", "", "read defaults for any other flags from `file`, one name = value pair per line; flags given on the command line take precedence")
+	minEntries      = flag.Int("min-entries", 0, "exit with an error instead of writing any output if fewer than `n` entries were collected")
+	idleTimeout     = flag.Duration("idle-timeout", 90*time.Second, "close connections that have been idle for `duration`; 0 means never")
+	maxIdleConns    = flag.Int("max-idle-conns", http.DefaultMaxIdleConnsPerHost, "keep at most `n` idle connections to each host for reuse")
+	respectRobots   = flag.Bool("respect-robots", false, "skip feeds that the robots.txt of their host disallows")
+	timeoutPerHost  = flag.Bool("timeout-per-host", true, "give hosts that are usually slow longer than -feed-timeout, up to four times as long; false always uses -feed-timeout")
+	latencyPath     = flag.String("host-latency", defaultCachePath("latency.json"), "remember how long each host usually takes to respond in `file`, for -timeout-per-host; empty only remembers for the run")
+	serveAddr       = flag.String("serve", "", "instead of writing the output once, serve it as html at / and json at /entries.json on `address`, such as :8080, refetching the feeds every -interval")
+	interval        = flag.Duration("interval", 15*time.Minute, "with -serve, refetch the feeds every `duration`")
+	usePublished    = flag.Bool("use-published", false, "date atom entries by when they were published rather than last updated, where they give both")
+	seenPath        = flag.String("seen", "", "remember the entries output in `file`, and mark those that weren't output last time as new")
+	resolveLinks    = flag.Bool("resolve-links", false, "follow redirects on entry links and deduplicate on the final URL; slow, as it costs a HEAD request per link")
+)
+
+// Entry is a single post from a feed. The html output template is executed
+// with a []section, so a template given with -template can use any of the
+// exported fields of each entry, such as EntryTitle, Link, Time, Author,
+// SourceTitle and Enclosure.URL, and the Summary, Text, PlayTime, Runtime,
+// Size and FaviconURL methods.
 type Entry struct {
 	EntryTitle  string
 	Link        string
 	Description string
-	Time        time.Time
+	// Content is the full text of the entry as HTML, where the feed gives it
+	// separately from a shorter Description.
+	Content string
+	Time    time.Time
+	// HasDate is false when the feed gave no date and Time was made up.
+	HasDate bool
+	// ID is the RSS guid or Atom id of the entry, if any.
+	ID string
+	// FeedURL is the URL of the feed the entry came from.
+	FeedURL string
+	// Category is the OPML category path of the feed the entry came from.
+	Category []string
+	Author   string
+	// Categories are the categories or tags the feed gives the entry,
+	// unrelated to the OPML category of the feed.
+	Categories []string
+	// Enclosure is the media file attached to the entry, if any.
+	Enclosure Enclosure
+	// Duration is how long a podcast episode lasts, if the feed says.
+	Duration time.Duration
+	// ImageURL is the artwork for a podcast episode, or for the show if the
+	// episode has none.
+	ImageURL string
+	// SourceTitle is the title of the feed the entry came from, or its host
+	// if the feed has no title.
+	SourceTitle string
+	// New is set when the entry wasn't in the output of the last run, with
+	// -seen.
+	New bool `json:"-"`
+
+	// feedOrder is where the entry's feed came in the OPML, and position
+	// is where the entry came in its feed. They keep entries that sort
+	// equally by date in a repeatable order.
+	feedOrder int
+	position  int
+	// resolved is the final URL of Link after following any redirects. It is
+	// only set when link resolution is enabled and succeeded.
+	resolved string
+}
+
+// faviconServices maps the values of -favicons to functions giving the icon
+// URL for the site at u.
+var faviconServices = map[string]func(u *url.URL) string{
+	"none": nil,
+	"site": func(u *url.URL) string { return u.Scheme + "://" + u.Host + "/favicon.ico" },
+	"duckduckgo": func(u *url.URL) string {
+		return "https://icons.duckduckgo.com/ip3/" + url.PathEscape(u.Hostname()) + ".ico"
+	},
+	"google": func(u *url.URL) string {
+		return "https://www.google.com/s2/favicons?domain=" + url.QueryEscape(u.Hostname())
+	},
+}
+
+// FaviconURL returns the URL of an icon for the site the entry links to, as
+// given by -favicons, or "" if there is none or the link can't be parsed.
+func (e Entry) FaviconURL() string {
+	service := faviconServices[*favicons]
+	if service == nil {
+		return ""
+	}
+	u, err := url.Parse(e.Link)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return service(u)
+}
+
+// PlayTime returns Duration as H:MM:SS, or M:SS if it is under an hour, or ""
+// if it is unknown.
+func (e Entry) PlayTime() string {
+	if e.Duration <= 0 {
+		return ""
+	}
+	seconds := int(e.Duration.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// Runtime returns Duration in words, such as "45 min" or "1 h 5 min", or ""
+// if it is unknown.
+func (e Entry) Runtime() string {
+	if e.Duration <= 0 {
+		return ""
+	}
+	if e.Duration < time.Minute {
+		return fmt.Sprintf("%d s", int(e.Duration.Round(time.Second)/time.Second))
+	}
+	minutes := int(e.Duration.Round(time.Minute) / time.Minute)
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%d min", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%d h", minutes/60)
+	default:
+		return fmt.Sprintf("%d h %d min", minutes/60, minutes%60)
+	}
+}
+
+// Size returns the size of the enclosure, which feeds give in bytes, in
+// decimal units such as "62 MB", or "" if it is unknown.
+func (e Entry) Size() string {
+	n, err := strconv.ParseInt(strings.TrimSpace(e.Enclosure.Length), 10, 64)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size := float64(n)
+	unit := ""
+	for _, unit = range []string{"kB", "MB", "GB", "TB"} {
+		size /= 1000
+		if size < 1000 {
+			break
+		}
+	}
+	if size < 10 {
+		return fmt.Sprintf("%.1f %s", size, unit)
+	}
+	return fmt.Sprintf("%.0f %s", size, unit)
+}
+
+// Text returns the fullest HTML the feed gives for the entry, its Content if
+// there is any and its Description otherwise.
+func (e Entry) Text() string {
+	if strings.TrimSpace(e.Content) != "" {
+		return e.Content
+	}
+	return e.Description
+}
+
+// Summary returns the entry's Text as plain text, cut at a word boundary to
+// around summaryLength runes.
+func (e Entry) Summary() string {
+	text := []rune(stripHTML(e.Text()))
+	if len(text) <= summaryLength {
+		return string(text)
+	}
+	cut := summaryLength
+	for i := cut; i > 0; i-- {
+		if unicode.IsSpace(text[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(text[:cut]), unicode.IsPunct) + "…"
+}
+
+// Enclosure is a media file attached to an entry, such as a podcast episode.
+type Enclosure struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+	// Length is the size of the file in bytes, as given by the feed.
+	Length string `xml:"length,attr"`
+}
+
+// section is the entries from feeds under one OPML category, split by day.
+type section struct {
+	// Category is the category path joined with slashes, or defaultSection
+	// for feeds outside any category.
+	Category string
+	Days     []dayGroup
+}
+
+// defaultSection heads the section for feeds at the top level of the OPML
+// file.
+const defaultSection = "Other"
+
+// groupByCategory splits entries, which must already be sorted by
+// sortEntries, into one section per OPML category path. Sections come in the
+// order of their newest entry, with the default section last.
+func groupByCategory(entries []Entry) []section {
+	var order []string
+	byCategory := make(map[string][]Entry)
+	for _, entry := range entries {
+		category := strings.Join(entry.Category, " / ")
+		if _, ok := byCategory[category]; !ok && category != "" {
+			order = append(order, category)
+		}
+		byCategory[category] = append(byCategory[category], entry)
+	}
+	var sections []section
+	for _, category := range order {
+		sections = append(sections, section{Category: category, Days: groupByDay(byCategory[category])})
+	}
+	if other := byCategory[""]; len(other) > 0 {
+		sections = append(sections, section{Category: defaultSection, Days: groupByDay(other)})
+	}
+	return sections
+}
+
+// dayGroup is the entries from a single day in the local timezone, newest
+// first.
+type dayGroup struct {
+	Date    string
+	Entries []Entry
+}
+
+// groupByDay splits entries, which must already be sorted by sortEntries, into
+// one group per calendar day, followed by a group of any undated entries.
+func groupByDay(entries []Entry) []dayGroup {
+	var groups []dayGroup
+	var last string
+	for _, entry := range entries {
+		day, date := entry.Time.Local().Format("2006-01-02"), entry.Time.Local().Format("Monday 2 January 2006")
+		if !entry.HasDate {
+			day, date = "", "Undated"
+		}
+		if len(groups) == 0 || day != last {
+			groups = append(groups, dayGroup{Date: date})
+			last = day
+		}
+		groups[len(groups)-1].Entries = append(groups[len(groups)-1].Entries, entry)
+	}
+	return groups
+}
+
+// Feed is the result of parsing a single feed document.
+type Feed struct {
+	Title string
+	// SelfURL is where the feed says it lives, which can differ from the
+	// URL it was fetched from.
+	SelfURL string
+	// Hub is the WebSub hub the feed advertises for push updates, if any.
+	Hub string
+	// Generator names the software that produced the feed, if it says.
+	Generator string
+	Entries   []Entry
+	// Skipped records why individual entries were left out, so that one bad
+	// entry doesn't cost the whole feed.
+	Skipped []error
 }
 
 type node struct {
@@ -67,66 +452,408 @@ type node struct {
 }
 
 type rss struct {
-	Items []item `xml:"channel>item"`
+	Base      string `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+	Title     string `xml:"channel>title"`
+	Generator string `xml:"channel>generator"`
+	// The channel's dates stand in for items that have none.
+	PubDate       string `xml:"channel>pubDate"`
+	LastBuildDate string `xml:"channel>lastBuildDate"`
+	// The show's author and artwork stand in for any episode without its
+	// own.
+	ITunesAuthor string      `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd channel>author"`
+	ITunesImage  itunesImage `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd channel>image"`
+	Items        []item      `xml:"channel>item"`
+	// Atom links are used in RSS to point back to the feed itself.
+	Links []link `xml:"http://www.w3.org/2005/Atom channel>link"`
+	// RSS 1.0 puts items alongside the channel rather than in it.
+	RDFItems []item `xml:"item"`
 }
 
 type item struct {
-	Title       string `xml:"title"`
-	PubDate     string `xml:"pubDate"`
-	Link        string `xml:"link"`
-	Description string `xml:"description"`
+	// The iTunes and Atom fields must come before the plain ones with the
+	// same names, which would otherwise match elements in any namespace.
+	ITunesAuthor   string         `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd author"`
+	ITunesSummary  string         `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd summary"`
+	ITunesDuration string         `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	ITunesImage    itunesImage    `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	AtomLinks      []link         `xml:"http://www.w3.org/2005/Atom link"`
+	Title          string         `xml:"title"`
+	PubDate        string         `xml:"pubDate"`
+	Link           string         `xml:"link"`
+	Description    string         `xml:"description"`
+	ContentEncoded string         `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	GUID           string         `xml:"guid"`
+	Author         string         `xml:"author"`
+	Creator        string         `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Date           string         `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Subjects       []string       `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Categories     []string       `xml:"category"`
+	Enclosure      Enclosure      `xml:"enclosure"`
+	Media          []mediaContent `xml:"http://search.yahoo.com/mrss/ content"`
+}
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type mediaContent struct {
+	URL      string `xml:"url,attr"`
+	Type     string `xml:"type,attr"`
+	FileSize string `xml:"fileSize,attr"`
 }
 
 type atom struct {
-	Entries []entry `xml:"entry"`
+	Base      string    `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+	Title     string    `xml:"title"`
+	Generator generator `xml:"generator"`
+	Entries   []entry   `xml:"entry"`
+	Links     []link    `xml:"link"`
+}
+
+type generator struct {
+	Name    string `xml:",chardata"`
+	Version string `xml:"version,attr"`
+}
+
+func (g generator) String() string {
+	return strings.TrimSpace(strings.TrimSpace(g.Name) + " " + strings.TrimSpace(g.Version))
 }
 
 type entry struct {
-	Title   string `xml:"title"`
-	Updated string `xml:"updated"`
-	Link    link   `xml:"link"`
+	Base       string     `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+	Title      string     `xml:"title"`
+	Updated    string     `xml:"updated"`
+	Published  string     `xml:"published"`
+	Links      []link     `xml:"link"`
+	ID         string     `xml:"id"`
+	Author     author     `xml:"author"`
+	Categories []category `xml:"category"`
+	Summary    atomText   `xml:"summary"`
+	Content    atomText   `xml:"content"`
+}
+
+// atomDate returns the name and value of the date to use for an atom entry:
+// when it was updated, or if it doesn't say, when it was published. With
+// -use-published the publication date comes first, so that editing an entry
+// doesn't move it.
+func atomDate(e entry) (string, string) {
+	published := strings.TrimSpace(e.Published) != ""
+	if published && (*usePublished || strings.TrimSpace(e.Updated) == "") {
+		return "Published", e.Published
+	}
+	return "Updated", e.Updated
+}
+
+// atomText is an Atom text construct such as summary or content, decoded to
+// HTML whatever its type.
+type atomText struct {
+	HTML string
+}
+
+// voidElements are the HTML elements that have no end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+func (t *atomText) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var typ string
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "type" {
+			typ = strings.ToLower(strings.TrimSpace(attr.Value))
+		}
+	}
+	xhtml := typ == "xhtml" || typ == "application/xhtml+xml"
+	// The decoder used for feeds can't collect innerxml, so xhtml is put
+	// back together from its tokens.
+	var b strings.Builder
+	// wrapped is set while inside the div that xhtml content is required
+	// to be wrapped in, which isn't part of the content itself.
+	wrapped := false
+	for depth := 0; ; {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if !xhtml {
+				continue
+			}
+			if depth == 1 && tok.Name.Local == "div" && strings.TrimSpace(b.String()) == "" {
+				wrapped = true
+				continue
+			}
+			b.WriteString("<" + tok.Name.Local)
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				b.WriteString(" " + attr.Name.Local + `="`)
+				xml.EscapeText(&b, []byte(attr.Value))
+				b.WriteString(`"`)
+			}
+			b.WriteString(">")
+		case xml.EndElement:
+			if depth == 0 {
+				t.HTML = strings.TrimSpace(b.String())
+				switch typ {
+				case "xhtml", "application/xhtml+xml", "html", "text/html":
+				default:
+					// Plain text, so escape it to match everything
+					// else in Description.
+					t.HTML = html.EscapeString(t.HTML)
+				}
+				return nil
+			}
+			depth--
+			if depth == 0 && wrapped {
+				wrapped = false
+				continue
+			}
+			if xhtml && !voidElements[tok.Name.Local] {
+				b.WriteString("</" + tok.Name.Local + ">")
+			}
+		case xml.CharData:
+			if xhtml {
+				xml.EscapeText(&b, tok)
+			} else {
+				b.Write(tok)
+			}
+		}
+	}
+}
+
+type category struct {
+	Term string `xml:"term,attr"`
+}
+type author struct {
+	Name string `xml:"name"`
 }
 
 type link struct {
-	Href string `xml:"href,attr"`
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length string `xml:"length,attr,omitempty"`
+}
+
+// atomEnclosure returns the first link to an attached file.
+func atomEnclosure(links []link) Enclosure {
+	for _, l := range links {
+		if l.Rel == "enclosure" && strings.TrimSpace(l.Href) != "" {
+			return Enclosure{URL: strings.TrimSpace(l.Href), Type: l.Type, Length: l.Length}
+		}
+	}
+	return Enclosure{}
+}
+
+// itemEnclosure returns the enclosure of an RSS item, falling back to the
+// first Media RSS content element.
+func itemEnclosure(item item) Enclosure {
+	if url := strings.TrimSpace(item.Enclosure.URL); url != "" {
+		enclosure := item.Enclosure
+		enclosure.URL = url
+		return enclosure
+	}
+	for _, media := range item.Media {
+		if url := strings.TrimSpace(media.URL); url != "" {
+			return Enclosure{URL: url, Type: media.Type, Length: media.FileSize}
+		}
+	}
+	return Enclosure{}
+}
+
+// resolveLink resolves ref, which may be relative, against base. Either being
+// unparseable leaves ref as it is.
+func resolveLink(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if base == "" || ref == "" {
+		return ref
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return baseURL.ResolveReference(refURL).String()
+}
+
+// resolveBase returns the base URL for the contents of an element with
+// xml:base xmlBase, inside one whose base URL is base.
+func resolveBase(base, xmlBase string) string {
+	if strings.TrimSpace(xmlBase) == "" {
+		return base
+	}
+	return resolveLink(base, xmlBase)
+}
+
+func resolveEnclosure(base string, enclosure Enclosure) Enclosure {
+	if enclosure.URL != "" {
+		enclosure.URL = resolveLink(base, enclosure.URL)
+	}
+	return enclosure
+}
+
+// relLink returns the first link with the relation rel.
+func relLink(links []link, rel string) string {
+	for _, l := range links {
+		if l.Rel == rel {
+			return strings.TrimSpace(l.Href)
+		}
+	}
+	return ""
+}
+
+// alternateLink picks the link most likely to lead to a readable page: an
+// alternate HTML link if there is one, then any alternate link, then
+// whichever link comes first. A missing rel means alternate.
+func alternateLink(links []link) string {
+	var alternate string
+	for _, l := range links {
+		if l.Rel != "" && l.Rel != "alternate" {
+			continue
+		}
+		if l.Type == "" || l.Type == "text/html" {
+			return l.Href
+		}
+		if alternate == "" {
+			alternate = l.Href
+		}
+	}
+	if alternate != "" {
+		return alternate
+	}
+	if len(links) > 0 {
+		return links[0].Href
+	}
+	return ""
 }
 
 type opml struct {
 	XMLName  xml.Name  `xml:"opml"`
+	Version  string    `xml:"version,attr"`
+	Title    string    `xml:"head>title,omitempty"`
 	Outlines []outline `xml:"body>outline"`
 }
 
 type outline struct {
-	Type     string    `xml:"type,attr"`
-	Text     string    `xml:"text,attr"`
-	XmlUrl   string    `xml:"xmlUrl,attr"`
+	Type   string `xml:"type,attr"`
+	Text   string `xml:"text,attr"`
+	XmlUrl string `xml:"xmlUrl,attr"`
+	// Timeout is read from an eris:timeout attribute; attributes without a
+	// namespace in the tag match regardless of prefix.
+	Timeout string `xml:"timeout,attr,omitempty"`
+	// User and Password are HTTP basic authentication credentials for
+	// private feeds.
+	User     string    `xml:"user,attr,omitempty"`
+	Password string    `xml:"password,attr,omitempty"`
 	Outlines []outline `xml:"outline"`
 }
 
-func parseFeed(feed []byte) ([]Entry, error) {
+// jsonFeed is a JSON Feed document, see https://jsonfeed.org/version/1.1.
+type jsonFeed struct {
+	Title   string     `json:"title"`
+	FeedURL string     `json:"feed_url"`
+	Hubs    []jsonHub  `json:"hubs"`
+	Items   []jsonItem `json:"items"`
+}
+
+type jsonItem struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Title         string `json:"title"`
+	ContentHTML   string `json:"content_html"`
+	ContentText   string `json:"content_text"`
+	DatePublished string `json:"date_published"`
+	DateModified  string `json:"date_modified"`
+	// Authors replaced Author in version 1.1, older feeds only have Author.
+	Authors     []jsonAuthor     `json:"authors"`
+	Author      jsonAuthor       `json:"author"`
+	Tags        []string         `json:"tags"`
+	Attachments []jsonAttachment `json:"attachments"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+type jsonHub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+type jsonAttachment struct {
+	URL      string      `json:"url"`
+	MIMEType string      `json:"mime_type"`
+	Size     json.Number `json:"size_in_bytes"`
+}
+
+// utf8BOM is the UTF-8 encoding of the byte order mark.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// parseFeed parses a feed fetched from base, which relative links in it are
+// resolved against.
+func parseFeed(base string, feed []byte) (Feed, error) {
+	// Some servers put a byte order mark or blank lines before the XML
+	// declaration, which isn't allowed there.
+	feed = bytes.TrimLeftFunc(bytes.TrimPrefix(bytes.TrimLeftFunc(feed, unicode.IsSpace), utf8BOM), unicode.IsSpace)
+	// JSON Feeds can't be told apart by their root element, but a JSON object
+	// can never be mistaken for XML.
+	if len(feed) > 0 && feed[0] == '{' {
+		return parseJSONFeed(base, feed)
+	}
 	var unknownFeed node
 	if err := unmarshal(feed, &unknownFeed); err != nil {
-		return nil, fmt.Errorf("unmarshaling unknown feed: %w", err)
+		return Feed{}, fmt.Errorf("unmarshaling unknown feed: %w", err)
 	}
-	var ret []Entry
+	var ret Feed
 	switch strings.ToLower(unknownFeed.XMLName.Local) {
 	case "feed":
 		var f atom
-		if err := unmarshal(feed, &f); err != nil {
-			return nil, fmt.Errorf("unmarshaling atom feed: %w", err)
+		if err := unmarshalFeed(feed, &f); err != nil {
+			return Feed{}, fmt.Errorf("unmarshaling atom feed: %w", err)
 		}
+		feedBase := resolveBase(base, f.Base)
+		ret.Title = cleanText(f.Title)
+		ret.Generator = f.Generator.String()
+		ret.SelfURL = resolveLink(feedBase, relLink(f.Links, "self"))
+		ret.Hub = resolveLink(feedBase, relLink(f.Links, "hub"))
 		for _, entry := range f.Entries {
-			date, err := parseDate(entry.Updated)
+			entryBase := resolveBase(feedBase, entry.Base)
+			dateName, dateString := atomDate(entry)
+			date, err := parseDate(dateString)
+			hasDate := err == nil
 			switch {
 			case errors.Is(err, errNoDate):
 				date = time.Now()
 			case err != nil:
-				return nil, fmt.Errorf("parse Updated node for atom entry: %w", err)
+				ret.Skipped = append(ret.Skipped, fmt.Errorf("parse %s node for atom entry %q: %w", dateName, entry.Title, err))
+				continue
+			}
+			description := entry.Summary.HTML
+			if description == "" {
+				description = entry.Content.HTML
 			}
-			ret = append(ret, Entry{
-				EntryTitle: entry.Title,
-				Link:       entry.Link.Href,
-				Time:       date,
+			entryLink := alternateLink(entry.Links)
+			if err := checkLink(entryLink); err != nil {
+				ret.Skipped = append(ret.Skipped, fmt.Errorf("atom entry %q: %w", entry.Title, err))
+				continue
+			}
+			ret.Entries = append(ret.Entries, Entry{
+				EntryTitle:  normalizeTitle(cleanText(entry.Title)),
+				Link:        resolveLink(entryBase, entryLink),
+				Description: description,
+				Content:     entry.Content.HTML,
+				Time:        date,
+				HasDate:     hasDate,
+				ID:          strings.TrimSpace(entry.ID),
+				Author:      cleanText(entry.Author.Name),
+				Categories:  atomCategories(entry.Categories),
+				Enclosure:   resolveEnclosure(entryBase, atomEnclosure(entry.Links)),
+				SourceTitle: ret.Title,
 			})
 		}
 		return ret, nil
@@ -134,173 +861,2102 @@ func parseFeed(feed []byte) ([]Entry, error) {
 		fallthrough
 	case "rss":
 		var f rss
-		if err := unmarshal(feed, &f); err != nil {
-			return nil, fmt.Errorf("unmarshaling rss feed: %w", err)
+		if err := unmarshalFeed(feed, &f); err != nil {
+			return Feed{}, fmt.Errorf("unmarshaling rss feed: %w", err)
 		}
-		for _, item := range f.Items {
-			date, err := parseDate(item.PubDate)
+		feedBase := resolveBase(base, f.Base)
+		ret.Title = cleanText(f.Title)
+		ret.Generator = strings.TrimSpace(f.Generator)
+		ret.SelfURL = resolveLink(feedBase, relLink(f.Links, "self"))
+		ret.Hub = resolveLink(feedBase, relLink(f.Links, "hub"))
+		for _, item := range append(f.Items, f.RDFItems...) {
+			pubDate := item.PubDate
+			// A date for the whole channel is only as fine as the last
+			// update, but it still orders its items against other feeds
+			// better than pretending they are new.
+			for _, fallback := range []string{item.Date, f.PubDate, f.LastBuildDate} {
+				if strings.TrimSpace(pubDate) != "" {
+					break
+				}
+				pubDate = fallback
+			}
+			date, err := parseDate(pubDate)
+			hasDate := err == nil
 			switch {
 			case errors.Is(err, errNoDate):
 				date = time.Now()
 			case err != nil:
-				return nil, fmt.Errorf("parse pubDate node for rss item: %w", err)
+				ret.Skipped = append(ret.Skipped, fmt.Errorf("parse pubDate node for rss item %q: %w", item.Title, err))
+				continue
+			}
+			if err := checkLink(item.Link); err != nil {
+				ret.Skipped = append(ret.Skipped, fmt.Errorf("rss item %q: %w", item.Title, err))
+				continue
+			}
+			itemAuthor := cleanAuthor(item.Author)
+			for _, fallback := range []string{item.Creator, item.ITunesAuthor, f.ITunesAuthor} {
+				if itemAuthor != "" {
+					break
+				}
+				itemAuthor = strings.TrimSpace(fallback)
+			}
+			description := item.Description
+			for _, fallback := range []string{item.ITunesSummary, item.ContentEncoded} {
+				if strings.TrimSpace(description) != "" {
+					break
+				}
+				description = fallback
+			}
+			image := item.ITunesImage.Href
+			if strings.TrimSpace(image) == "" {
+				image = f.ITunesImage.Href
 			}
-			ret = append(ret, Entry{
-				EntryTitle:  item.Title,
-				Link:        item.Link,
-				Description: item.Description,
+			ret.Entries = append(ret.Entries, Entry{
+				EntryTitle:  normalizeTitle(cleanText(item.Title)),
+				Link:        resolveLink(feedBase, item.Link),
+				Description: description,
+				Content:     item.ContentEncoded,
 				Time:        date,
+				HasDate:     hasDate,
+				ID:          strings.TrimSpace(item.GUID),
+				Author:      cleanText(itemAuthor),
+				Categories:  rssCategories(item),
+				Enclosure:   resolveEnclosure(feedBase, itemEnclosure(item)),
+				Duration:    parseITunesDuration(item.ITunesDuration),
+				ImageURL:    resolveLink(feedBase, strings.TrimSpace(image)),
+				SourceTitle: ret.Title,
 			})
 		}
 		return ret, nil
 	default:
-		return nil, errors.New("unknown feed type")
+		return Feed{}, errUnknownFeedType
 	}
 }
 
-var dateFormats = []string{
-	time.RFC822,
-	time.RFC822Z,
-	time.RFC1123,
-	time.RFC1123Z,
-	time.RFC3339,
-	"02 Jan 2006 15:04:05 MST",       // RFC822 with full year and seconds
-	"02 Jan 2006 15:04:05 -0700",     // RFC822Z with full year and seconds
-	"2 Jan 2006 15:04:05 -0700",      // RFC822Z with full year, seconds and without padded day
-	"Mon, 2 Jan 2006 15:04:05 MST",   // RFC1123 without padded day
-	"Mon, 2 Jan 2006 15:04:05 -0700", // RFC1123Z without padded day
-	"2006-01-02",                     // RFC3339 date only
-	"2006-01-02 15:04:05",            // A common attempt at RFC3339 but with no timezone or 'T' delimiter
+// parseITunesDuration reads an itunes:duration, which can be a number of
+// seconds, M:SS or H:MM:SS. It returns 0 for anything else.
+func parseITunesDuration(s string) time.Duration {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0
+	}
+	var total float64
+	for _, part := range parts {
+		// Some feeds give fractions of a second.
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		total = total*60 + n
+	}
+	return time.Duration(total * float64(time.Second))
 }
 
-var errNoDate = errors.New("no date specified")
-
-func parseDate(dateString string) (time.Time, error) {
-	dateString = strings.TrimSpace(dateString)
-	if dateString == "" {
-		return time.Time{}, errNoDate
-	}
-	for _, format := range dateFormats {
-		if t, err := time.Parse(format, dateString); err == nil {
-			return t, nil
+// cleanCategories trims categories and drops any that are empty.
+func cleanCategories(categories []string) []string {
+	var ret []string
+	for _, category := range categories {
+		if category = strings.TrimSpace(category); category != "" {
+			ret = append(ret, category)
 		}
 	}
-	return time.Time{}, fmt.Errorf("cannot parse date string: %q", dateString)
+	return ret
 }
 
-func unmarshal(data []byte, v interface{}) error {
-	decoder := xml.NewDecoder(bytes.NewReader(data))
-	decoder.Strict = false
-	decoder.CharsetReader = charset.NewReaderLabel
-	return decoder.Decode(v)
+// rssCategories returns the categories of an RSS item, or its Dublin Core
+// subjects if it has none, as journal feeds tend to give those instead.
+func rssCategories(item item) []string {
+	if categories := cleanCategories(item.Categories); len(categories) > 0 {
+		return categories
+	}
+	return cleanCategories(item.Subjects)
 }
 
-func parseOPML(oo []outline) []string {
-	var ret []string
-	for _, o := range oo {
-		if o.Type == "rss" {
-			ret = append(ret, o.XmlUrl)
+func atomCategories(categories []category) []string {
+	terms := make([]string, len(categories))
+	for i, category := range categories {
+		terms[i] = category.Term
+	}
+	return cleanCategories(terms)
+}
+
+// cleanAuthor extracts a name from an RSS author, which is meant to be an
+// email address and so often comes as "jo@example.com (Jo Bloggs)" or
+// "Jo Bloggs <jo@example.com>".
+func cleanAuthor(author string) string {
+	author = strings.TrimSpace(author)
+	if open, end := strings.Index(author, "("), strings.LastIndex(author, ")"); open >= 0 && end > open {
+		if name := strings.TrimSpace(author[open+1 : end]); name != "" {
+			return name
 		}
-		ret = append(ret, parseOPML(o.Outlines)...)
 	}
-	return ret
+	if open := strings.Index(author, "<"); open > 0 {
+		if name := strings.TrimSpace(author[:open]); name != "" {
+			return name
+		}
+	}
+	return author
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Please specify an opml file to read feeds from.")
-		os.Exit(1)
+// cleanText trims s and unescapes one level of HTML entities in it. XML feeds
+// often escape text twice, or escape it inside CDATA where the XML decoder
+// leaves it alone, so entities would otherwise show up literally in the output.
+// Only one level is undone, so text that really is about entities survives.
+func cleanText(s string) string {
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// normalizeTitle puts title into Unicode normalization form C. Feeds from
+// different platforms disagree on whether accented characters are composed, so
+// without this the same title can compare unequal to itself.
+func normalizeTitle(title string) string {
+	return norm.NFC.String(title)
+}
+
+// mergeEntries combines two copies of the same entry. Each field takes its
+// value from the newer copy unless it is empty there. Of two copies from the
+// same time, the one listed first counts as newer.
+func mergeEntries(a, b Entry) Entry {
+	newer, older := b, a
+	if a.Time.After(b.Time) || a.Time.Equal(b.Time) && listedBefore(a, b) {
+		newer, older = a, b
 	}
-	log.SetOutput(os.Stderr)
-	feedFile, err := os.Open(os.Args[1])
-	if err != nil {
-		fmt.Printf("Could not open file %q: %v\n", os.Args[1], err)
-		os.Exit(1)
+	merged := newer
+	if merged.EntryTitle == "" {
+		merged.EntryTitle = older.EntryTitle
 	}
-	var OPML opml
-	if err := xml.NewDecoder(feedFile).Decode(&OPML); err != nil {
-		fmt.Printf("Could not parse OPML: %v\n", err)
-		os.Exit(1)
+	if merged.Link == "" {
+		merged.Link = older.Link
 	}
-	feedUrls := parseOPML(OPML.Outlines)
-	tmpl := template.Must(template.New("feeds").Parse(feedTmpl))
-	client := &http.Client{
-		Timeout: clientTimeout,
-		Transport: &http.Transport{
-			MaxConnsPerHost: connsPerHost,
-		},
+	if merged.Description == "" {
+		merged.Description = older.Description
 	}
+	if merged.Content == "" {
+		merged.Content = older.Content
+	}
+	if merged.ID == "" {
+		merged.ID = older.ID
+	}
+	if merged.Author == "" {
+		merged.Author = older.Author
+	}
+	if len(merged.Categories) == 0 {
+		merged.Categories = older.Categories
+	}
+	if merged.Enclosure.URL == "" {
+		merged.Enclosure = older.Enclosure
+	}
+	if merged.Duration == 0 {
+		merged.Duration = older.Duration
+	}
+	if merged.ImageURL == "" {
+		merged.ImageURL = older.ImageURL
+	}
+	if merged.SourceTitle == "" {
+		merged.SourceTitle = older.SourceTitle
+	}
+	if merged.resolved == "" {
+		merged.resolved = older.resolved
+	}
+	// An undated copy only looks newer because its time was made up.
+	if !merged.HasDate && older.HasDate {
+		merged.Time = older.Time
+		merged.HasDate = true
+	}
+	return merged
+}
 
-	entryChan := make(chan []Entry)
-	var wg sync.WaitGroup
-	for _, text := range feedUrls {
-		wg.Add(1)
-		go func(url string) {
-			defer wg.Done()
-			req, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				log.Printf("error creating request for %q: %v\n", url, err)
-				return
-			}
-			req.Header.Add("User-Agent", "eris (https://github.com/admacleod/eris)")
-			res, err := client.Do(req)
-			if err != nil {
-				// Ignore HTTP errors, all they do is clog up logs when servers
-				// temporarily go offline.
-				return
-			}
-			if res.StatusCode != http.StatusOK {
-				log.Printf("non-OK status code from %q: %d %s", url, res.StatusCode, res.Status)
-				return
-			}
-			defer func() {
-				if err := res.Body.Close(); err != nil {
-					log.Printf("error closing request body for %q: %v\n", url, err)
-				}
-			}()
-			rawFeed, err := io.ReadAll(res.Body)
-			if err != nil {
-				log.Printf("error reading feeds for %q: %v\n", url, err)
-				return
-			}
-			parsedEntries, err := parseFeed(rawFeed)
-			if err != nil {
-				log.Printf("error gathering feed entries for %q: %v\n", url, err)
-				return
-			}
-			entryChan <- parsedEntries
-		}(text)
+func parseJSONFeed(base string, feed []byte) (Feed, error) {
+	var f jsonFeed
+	if err := json.Unmarshal(feed, &f); err != nil {
+		return Feed{}, fmt.Errorf("unmarshaling json feed: %w", err)
+	}
+	ret := Feed{Title: strings.TrimSpace(f.Title), SelfURL: strings.TrimSpace(f.FeedURL)}
+	for _, hub := range f.Hubs {
+		if strings.EqualFold(hub.Type, "WebSub") {
+			ret.Hub = resolveLink(base, hub.URL)
+			break
+		}
+	}
+	for _, item := range f.Items {
+		dateString := item.DatePublished
+		if strings.TrimSpace(dateString) == "" {
+			dateString = item.DateModified
+		}
+		date, err := parseDate(dateString)
+		hasDate := err == nil
+		switch {
+		case errors.Is(err, errNoDate):
+			date = time.Now()
+		case err != nil:
+			ret.Skipped = append(ret.Skipped, fmt.Errorf("parse date_published for json item %q: %w", item.Title, err))
+			continue
+		}
+		if err := checkLink(item.URL); err != nil {
+			ret.Skipped = append(ret.Skipped, fmt.Errorf("json item %q: %w", item.Title, err))
+			continue
+		}
+		// Description is HTML, so the plain text has to be escaped to
+		// stay as it is.
+		description := item.ContentText
+		if description == "" {
+			description = stripHTML(item.ContentHTML)
+		}
+		description = html.EscapeString(description)
+		itemAuthor := item.Author.Name
+		if len(item.Authors) > 0 {
+			itemAuthor = item.Authors[0].Name
+		}
+		ret.Entries = append(ret.Entries, Entry{
+			EntryTitle:  normalizeTitle(item.Title),
+			Link:        resolveLink(base, item.URL),
+			Description: description,
+			Content:     item.ContentHTML,
+			Time:        date,
+			HasDate:     hasDate,
+			ID:          strings.TrimSpace(item.ID),
+			Author:      strings.TrimSpace(itemAuthor),
+			Categories:  cleanCategories(item.Tags),
+			Enclosure:   resolveEnclosure(base, jsonEnclosure(item.Attachments)),
+			SourceTitle: ret.Title,
+		})
 	}
+	return ret, nil
+}
 
-	entrySet := make(map[string]Entry)
-	done := make(chan struct{})
-	go func() {
-		for entries := range entryChan {
-			for _, entry := range entries {
-				entrySet[entry.Link] = entry
-			}
+func jsonEnclosure(attachments []jsonAttachment) Enclosure {
+	for _, attachment := range attachments {
+		if url := strings.TrimSpace(attachment.URL); url != "" {
+			return Enclosure{URL: url, Type: attachment.MIMEType, Length: attachment.Size.String()}
 		}
-		close(done)
-	}()
+	}
+	return Enclosure{}
+}
+
+// stripHTML returns the text content of an HTML fragment with tags removed
+// and runs of whitespace collapsed to a single space.
+func stripHTML(fragment string) string {
+	var text strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(fragment))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(text.String()), " ")
+		case html.TextToken:
+			text.Write(tokenizer.Text())
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			// Tags usually separate words, even where the markup doesn't
+			// put whitespace between them.
+			text.WriteByte(' ')
+		}
+	}
+}
 
-	wg.Wait()
-	close(entryChan)
-	<-done
+// entrySet deduplicates entries as they are collected. Entries are the same if
+// they have the same ID within one feed, since a GUID is only promised to be
+// unique within its feed, or if they have the same link.
+type entrySet struct {
+	entries map[string]Entry
+	// keys maps every identity an entry has been seen under to the key it
+	// is stored under in entries.
+	keys map[string]string
+	// merge combines duplicates with mergeEntries, and also matches entries
+	// with the same ID in different feeds.
+	merge bool
+}
 
-	var entries []Entry
-	for _, entry := range entrySet {
-		entries = append(entries, entry)
+func newEntrySet(merge bool) *entrySet {
+	return &entrySet{
+		entries: make(map[string]Entry),
+		keys:    make(map[string]string),
+		merge:   merge,
+	}
+}
+
+// identities returns the keys entry can be matched by, most specific first.
+func (s *entrySet) identities(entry Entry) []string {
+	var ids []string
+	if entry.ID != "" {
+		ids = append(ids, "id:"+entry.FeedURL+" "+entry.ID)
+		if s.merge {
+			ids = append(ids, "guid:"+entry.ID)
+		}
 	}
+	link := entry.Link
+	if entry.resolved != "" {
+		link = entry.resolved
+	}
+	return append(ids, "link:"+normalizeLink(link))
+}
 
-	sort.SliceStable(entries, func(i, j int) bool {
-		return entries[i].Time.After(entries[j].Time)
-	})
+// trackingParams are query parameters that only identify where a link was
+// followed from, so links differing only in them point to the same thing. A
+// trailing * matches any parameter with that prefix.
+var trackingParams = []string{"utm_*", "fbclid", "gclid"}
 
-	if len(entries) > maxEntries {
-		entries = entries[:maxEntries]
+// normalizeLink returns a form of raw that is the same for links that only
+// differ in their host's case, an explicit default port, tracking parameters
+// or a trailing slash. Links that can't be parsed are returned unchanged.
+func normalizeLink(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
 	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			if isTrackingParam(name) {
+				query.Del(name)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String()
+}
 
-	if err := tmpl.Execute(os.Stdout, entries); err != nil {
-		log.Fatalf("error executing html template: %v\n", err)
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, params := range [][]string{trackingParams, stripParams} {
+		for _, param := range params {
+			param = strings.ToLower(param)
+			if prefix := strings.TrimSuffix(param, "*"); prefix != param {
+				if strings.HasPrefix(name, prefix) {
+					return true
+				}
+			} else if name == param {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add stores entry, merging with any entry it duplicates or else keeping
+// whichever of the two is listed first.
+func (s *entrySet) add(entry Entry) {
+	ids := s.identities(entry)
+	key := ids[0]
+	for _, id := range ids {
+		if existing, ok := s.keys[id]; ok {
+			key = existing
+			break
+		}
+	}
+	// Feeds are fetched in no particular order, so which copy is kept
+	// mustn't depend on which arrived first.
+	if old, ok := s.entries[key]; ok {
+		if s.merge {
+			entry = mergeEntries(old, entry)
+		} else if listedBefore(old, entry) {
+			entry = old
+		}
+	}
+	s.entries[key] = entry
+	for _, id := range ids {
+		s.keys[id] = key
+	}
+}
+
+// has reports whether entry duplicates one already in the set.
+func (s *entrySet) has(entry Entry) bool {
+	for _, id := range s.identities(entry) {
+		if _, ok := s.keys[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// markNew sets New on the entries that aren't in seen, and returns the
+// identities of all of them to be seen next time. A nil seen marks nothing,
+// since everything would be new on the first run.
+func markNew(entries []Entry, seen map[string]bool) []string {
+	identities := newEntrySet(false).identities
+	var ids []string
+	for i, entry := range entries {
+		entryIDs := identities(entry)
+		isNew := seen != nil
+		for _, id := range entryIDs {
+			if seen[id] {
+				isNew = false
+			}
+		}
+		entries[i].New = isNew
+		ids = append(ids, entryIDs...)
+	}
+	return ids
+}
+
+func (s *entrySet) list() []Entry {
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// checkLink reports whether link is too malformed to be worth rendering.
+func checkLink(link string) error {
+	if _, err := url.Parse(strings.TrimSpace(link)); err != nil {
+		return fmt.Errorf("malformed link: %w", err)
+	}
+	return nil
+}
+
+var dateFormats = []string{
+	time.RFC822,
+	time.RFC822Z,
+	time.RFC1123,
+	time.RFC1123Z,
+	time.RFC3339,
+	"02 Jan 2006 15:04:05 MST",       // RFC822 with full year and seconds
+	"02 Jan 2006 15:04:05 -0700",     // RFC822Z with full year and seconds
+	"2 Jan 2006 15:04:05 -0700",      // RFC822Z with full year, seconds and without padded day
+	"Mon, 2 Jan 2006 15:04:05 MST",   // RFC1123 without padded day
+	"Mon, 2 Jan 2006 15:04:05 -0700", // RFC1123Z without padded day
+	"2006-01-02T15:04Z07:00",         // W3CDTF, as used by dc:date, without seconds
+	"2006-01-02",                     // RFC3339 date only
+	"2006-01-02 15:04:05",            // A common attempt at RFC3339 but with no timezone or 'T' delimiter
+}
+
+var errNoDate = errors.New("no date specified")
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+var errUnknownFeedType = errors.New("unknown feed type")
+
+// zoneOffsets maps the time zone abbreviations feeds commonly use to their
+// offsets. time.Parse accepts any abbreviation but only knows the offset of
+// the local zone's, treating the rest as UTC. Abbreviations that mean more than
+// one zone get the North American or European one, so CST is US Central rather
+// than China and IST is Irish rather than Indian.
+var zoneOffsets = map[string]string{
+	"UT": "+0000", "UTC": "+0000", "GMT": "+0000", "Z": "+0000",
+	"EST": "-0500", "EDT": "-0400",
+	"CST": "-0600", "CDT": "-0500",
+	"MST": "-0700", "MDT": "-0600",
+	"PST": "-0800", "PDT": "-0700",
+	"AKST": "-0900", "AKDT": "-0800",
+	"HST": "-1000",
+	"AST": "-0400", "ADT": "-0300",
+	"NST": "-0330", "NDT": "-0230",
+	"WET": "+0000", "WEST": "+0100", "BST": "+0100", "IST": "+0100",
+	"CET": "+0100", "CEST": "+0200", "MET": "+0100", "MEST": "+0200",
+	"EET": "+0200", "EEST": "+0300",
+	"MSK": "+0300",
+}
+
+// numericZone replaces a time zone abbreviation at the end of dateString with
+// its numeric offset, so that the time isn't silently read as UTC.
+func numericZone(dateString string) string {
+	i := strings.LastIndexByte(dateString, ' ')
+	if i < 0 {
+		return dateString
+	}
+	if offset, ok := zoneOffsets[strings.ToUpper(dateString[i+1:])]; ok {
+		return dateString[:i+1] + offset
+	}
+	return dateString
+}
+
+// parseEpoch parses a Unix timestamp, which some feeds give instead of a date.
+// Ten digits or so are seconds, thirteen are milliseconds. Other lengths are
+// more likely to be something else, such as a date without separators.
+func parseEpoch(s string) (time.Time, bool) {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return time.Time{}, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	switch len(s) {
+	case 9, 10, 11:
+		return time.Unix(n, 0).UTC(), true
+	case 13:
+		return time.UnixMilli(n).UTC(), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func parseDate(dateString string) (time.Time, error) {
+	dateString = strings.TrimSpace(dateString)
+	if dateString == "" {
+		return time.Time{}, errNoDate
+	}
+	dateString = numericZone(dateString)
+	for _, format := range dateFormats {
+		if t, err := time.Parse(format, dateString); err == nil {
+			return t, nil
+		}
+	}
+	if t, ok := parseEpoch(dateString); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse date string: %q", dateString)
+}
+
+func newDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.CharsetReader = charsetReader
+	return decoder
+}
+
+// charsetReader is the xml.Decoder CharsetReader, converting input in the
+// encoding named label to UTF-8.
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	enc, _ := lookupCharset(label)
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported charset: %q", label)
+	}
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
+
+// lookupCharset returns the encoding named label and its canonical name, or
+// nil if it is unknown. WHATWG names are tried first, as browsers do, so that
+// ISO-8859-1 gets the Windows-1252 superset that feeds claiming it really use.
+// The IANA registry covers the names the WHATWG leaves out, such as IBM437.
+func lookupCharset(label string) (encoding.Encoding, string) {
+	label = strings.TrimSpace(label)
+	if enc, name := charset.Lookup(label); enc != nil {
+		return enc, name
+	}
+	enc, err := ianaindex.IANA.Encoding(label)
+	if err != nil || enc == nil {
+		return nil, ""
+	}
+	name, _ := ianaindex.IANA.Name(enc)
+	return enc, strings.ToLower(name)
+}
+
+// unmarshal decodes data into v exactly as written. Use it for types relying
+// on innerxml, which isn't available through unmarshalFeed.
+func unmarshal(data []byte, v interface{}) error {
+	return newDecoder(data).Decode(v)
+}
+
+// unmarshalFeed decodes data into one of the feed structs, matching the
+// element and attribute names they use regardless of case.
+//
+// Struct tags without a namespace already match elements in any namespace,
+// so oddly prefixed standard elements need no extra handling.
+func unmarshalFeed(data []byte, v interface{}) error {
+	decoder := xml.NewTokenDecoder(canonicalTokens{newDecoder(data)})
+	decoder.Strict = false
+	return decoder.Decode(v)
+}
+
+// feedNames maps the lower case form of every element and attribute name used
+// in the feed struct tags to the spelling used in the tag. Names missing from
+// here are only matched if a feed gets the case exactly right.
+var feedNames = func(names ...string) map[string]string {
+	m := make(map[string]string, len(names))
+	for _, name := range names {
+		m[strings.ToLower(name)] = name
+	}
+	return m
+}(
+	"channel", "item", "title", "link", "description", "pubDate", "generator",
+	"entry", "updated", "href", "rel", "type", "version", "guid", "id",
+	"author", "name", "creator", "category", "term", "enclosure", "url",
+	"length", "content", "fileSize", "date", "summary", "duration", "image",
+	"lastBuildDate", "encoded", "published", "subject",
+)
+
+// canonicalTokens is an xml.TokenReader that rewrites the names of StartElement
+// and EndElement tokens, and their attributes, to the spelling in feedNames.
+type canonicalTokens struct {
+	decoder *xml.Decoder
+}
+
+func (c canonicalTokens) Token() (xml.Token, error) {
+	tok, err := c.decoder.Token()
+	switch t := tok.(type) {
+	case xml.StartElement:
+		t.Name.Local = canonicalName(t.Name.Local)
+		attrs := make([]xml.Attr, len(t.Attr))
+		for i, attr := range t.Attr {
+			attr.Name.Local = canonicalName(attr.Name.Local)
+			attrs[i] = attr
+		}
+		t.Attr = attrs
+		return t, err
+	case xml.EndElement:
+		t.Name.Local = canonicalName(t.Name.Local)
+		return t, err
+	}
+	return tok, err
+}
+
+func canonicalName(name string) string {
+	if canonical, ok := feedNames[strings.ToLower(name)]; ok {
+		return canonical
+	}
+	return name
+}
+
+// feedSource is a feed found in an OPML file along with its category path,
+// the text of each outline it is nested under, outermost first.
+type feedSource struct {
+	URL      string
+	Category []string
+	// Timeout overrides -feed-timeout for this feed when non-zero.
+	Timeout time.Duration
+	// Auth is sent with every request for the feed. It is kept apart from
+	// URL so that the URL can be logged and used as a key safely.
+	Auth credentials
+}
+
+// credentials are HTTP basic authentication credentials.
+type credentials struct {
+	User     string
+	Password string
+}
+
+// set adds an Authorization header to req if there are any credentials.
+func (c credentials) set(req *http.Request) {
+	if c.User != "" || c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+}
+
+// splitCredentials removes any user information from rawURL, returning it as
+// credentials.
+func splitCredentials(rawURL string) (string, credentials) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL, credentials{}
+	}
+	password, _ := u.User.Password()
+	auth := credentials{User: u.User.Username(), Password: password}
+	u.User = nil
+	return u.String(), auth
+}
+
+// parseOPMLReader decodes an OPML document from r and returns every feed it
+// lists, along with the category path of each.
+func parseOPMLReader(r io.Reader) ([]feedSource, error) {
+	var OPML opml
+	if err := xml.NewDecoder(r).Decode(&OPML); err != nil {
+		return nil, err
+	}
+	return parseOPML(OPML.Outlines), nil
+}
+
+// readOPML reads the feeds from the OPML file called name, or from stdin if
+// name is "-", for use in pipelines.
+func readOPML(name string) ([]feedSource, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseOPMLOrFeed(data)
+}
+
+// parseOPMLOrFeed parses data as OPML. Feeds are easily passed by mistake, so a
+// feed that says where it is served from is taken as a list of just that feed,
+// and anything else that isn't OPML gets an error saying what it is instead.
+func parseOPMLOrFeed(data []byte) ([]feedSource, error) {
+	var root struct{ XMLName xml.Name }
+	if err := newDecoder(data).Decode(&root); err == nil && strings.EqualFold(root.XMLName.Local, "opml") {
+		return parseOPMLBytes(data)
+	}
+	feed, err := parseFeed("", data)
+	switch {
+	case err == nil && feed.SelfURL != "":
+		slog.Info("file is a feed rather than OPML, fetching it from its self link", "url", feed.SelfURL)
+		return []feedSource{{URL: feed.SelfURL}}, nil
+	case err == nil:
+		return nil, errors.New("file is a feed rather than OPML, and doesn't say where it is served from; list its URL in an OPML file instead")
+	case root.XMLName.Local != "":
+		return nil, fmt.Errorf("file does not look like OPML; root element was %q", root.XMLName.Local)
+	}
+	// Neither OPML nor a feed, so the OPML error is the most useful.
+	return parseOPMLBytes(data)
+}
+
+// uniqueFeeds drops all but the first of any feeds with the same URL, so that
+// a feed listed more than once, perhaps in several OPML files, is only fetched
+// once.
+func uniqueFeeds(feeds []feedSource) []feedSource {
+	seen := make(map[string]bool, len(feeds))
+	var ret []feedSource
+	for _, feed := range feeds {
+		if !seen[feed.URL] {
+			seen[feed.URL] = true
+			ret = append(ret, feed)
+		}
+	}
+	return ret
+}
+
+// parseOPMLBytes is like parseOPMLReader but reads from an in-memory document.
+func parseOPMLBytes(data []byte) ([]feedSource, error) {
+	return parseOPMLReader(bytes.NewReader(data))
+}
+
+func parseOPML(oo []outline) []feedSource {
+	return parseOutlines(oo, nil)
+}
+
+func parseOutlines(oo []outline, category []string) []feedSource {
+	var ret []feedSource
+	for _, o := range oo {
+		// Some readers leave out type="rss", so anything with a feed URL
+		// counts. Outlines without one only group their children.
+		if strings.TrimSpace(o.XmlUrl) != "" {
+			feedURL, auth := splitCredentials(o.XmlUrl)
+			if o.User != "" || o.Password != "" {
+				auth = credentials{User: o.User, Password: o.Password}
+			}
+			source := feedSource{URL: feedURL, Category: category, Auth: auth}
+			if o.Timeout != "" {
+				timeout, err := time.ParseDuration(o.Timeout)
+				if err != nil {
+					slog.Warn("ignoring invalid timeout", "url", feedURL, "err", err)
+				} else {
+					source.Timeout = timeout
+				}
+			}
+			ret = append(ret, source)
+		}
+		// Copy rather than append to category so that sibling outlines can't
+		// overwrite each other's paths through a shared backing array.
+		child := make([]string, len(category), len(category)+1)
+		copy(child, category)
+		ret = append(ret, parseOutlines(o.Outlines, append(child, o.Text))...)
+	}
+	return ret
+}
+
+// parseCategoryLimits turns name=n pairs into a map keyed by lower case
+// category name.
+func parseCategoryLimits(pairs []string) (map[string]int, error) {
+	limits := make(map[string]int, len(pairs))
+	for _, pair := range pairs {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("category limit %q is not of the form name=n", pair)
+		}
+		n, err := strconv.Atoi(pair[i+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("category limit %q does not end in a non-negative number", pair)
+		}
+		limits[strings.ToLower(pair[:i])] = n
+	}
+	return limits, nil
+}
+
+// limitPerFeed keeps at most limit entries, which must already be sorted, from
+// each feed, preserving order.
+func limitPerFeed(entries []Entry, limit int) []Entry {
+	counts := make(map[string]int)
+	var ret []Entry
+	for _, entry := range entries {
+		if counts[entry.FeedURL] >= limit {
+			continue
+		}
+		counts[entry.FeedURL]++
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// limitPerCategory keeps at most limit entries from each top-level category,
+// or the override for that category if there is one, preserving order.
+// Entries from uncategorised feeds are counted together as one category. A
+// limit of 0 means no limit.
+func limitPerCategory(entries []Entry, limit int, overrides map[string]int) []Entry {
+	counts := make(map[string]int)
+	var ret []Entry
+	for _, entry := range entries {
+		var category string
+		if len(entry.Category) > 0 {
+			category = strings.ToLower(entry.Category[0])
+		}
+		keep := limit
+		if override, ok := overrides[category]; ok {
+			keep = override
+		}
+		if keep > 0 && counts[category] >= keep {
+			continue
+		}
+		counts[category]++
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// filterTags returns the entries with any category in include, or every entry
+// if include is empty, leaving out those with any category in exclude.
+func filterTags(entries []Entry, include, exclude []string) []Entry {
+	hasAny := func(entry Entry, tags []string) bool {
+		for _, category := range entry.Categories {
+			for _, tag := range tags {
+				if strings.EqualFold(category, tag) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var ret []Entry
+	for _, entry := range entries {
+		if len(include) > 0 && !hasAny(entry, include) {
+			continue
+		}
+		if hasAny(entry, exclude) {
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// filterCategories returns the feeds whose top-level category matches one of
+// categories, ignoring case.
+func filterCategories(feeds []feedSource, categories []string) []feedSource {
+	var ret []feedSource
+	for _, feed := range feeds {
+		if len(feed.Category) == 0 {
+			continue
+		}
+		for _, category := range categories {
+			if strings.EqualFold(feed.Category[0], category) {
+				ret = append(ret, feed)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// filterFeeds keeps the feeds whose URLs match any of include, or every feed if
+// include is empty, and then drops those matching any of exclude. See
+// matchFeedURL for the patterns.
+func filterFeeds(feeds []feedSource, include, exclude []string) []feedSource {
+	matchAny := func(patterns []string, feedURL string) bool {
+		for _, pattern := range patterns {
+			if matchFeedURL(pattern, feedURL) {
+				return true
+			}
+		}
+		return false
+	}
+	var ret []feedSource
+	for _, feed := range feeds {
+		if len(include) > 0 && !matchAny(include, feed.URL) {
+			continue
+		}
+		if matchAny(exclude, feed.URL) {
+			continue
+		}
+		ret = append(ret, feed)
+	}
+	return ret
+}
+
+// matchFeedURL reports whether feedURL matches pattern, ignoring case. A
+// pattern containing * or ? must match the whole URL, with * matching any run
+// of characters, slashes included, and ? any one character. Any other pattern
+// only has to appear somewhere in the URL.
+func matchFeedURL(pattern, feedURL string) bool {
+	p, u := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(feedURL))
+	if !strings.ContainsAny(pattern, "*?") {
+		return strings.Contains(string(u), string(p))
+	}
+	// Backtrack to just after the last * whenever a match fails.
+	pi, ui, star, mark := 0, 0, -1, 0
+	for ui < len(u) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == u[ui]):
+			pi++
+			ui++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ui
+			pi++
+		case star >= 0:
+			mark++
+			pi, ui = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// linkResolver follows redirects on entry links so that entries reaching the
+// same article through different short or tracking URLs can be deduplicated.
+// Results are cached for the duration of the run.
+type linkResolver struct {
+	client *http.Client
+	sem    chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newLinkResolver(client *http.Client) *linkResolver {
+	return &linkResolver{
+		client: client,
+		sem:    make(chan struct{}, resolveConns),
+		cache:  make(map[string]string),
+	}
+}
+
+// resolve returns the final URL for link, or link itself if it could not be
+// resolved.
+func (r *linkResolver) resolve(ctx context.Context, link string) string {
+	r.mu.Lock()
+	resolved, ok := r.cache[link]
+	r.mu.Unlock()
+	if ok {
+		return resolved
+	}
+	r.sem <- struct{}{}
+	resolved = r.head(ctx, link)
+	<-r.sem
+	r.mu.Lock()
+	r.cache[link] = resolved
+	r.mu.Unlock()
+	return resolved
+}
+
+func (r *linkResolver) head(ctx context.Context, link string) string {
+	ctx, err := waitTurn(ctx, r.client, link)
+	if err != nil {
+		return link
+	}
+	ctx, cancel := context.WithTimeout(ctx, *feedTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", link, nil)
+	if err != nil {
+		return link
+	}
+	addIdentity(req)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return link
+	}
+	if err := res.Body.Close(); err != nil {
+		slog.Error("error closing HEAD response body", "url", link, "err", err)
+	}
+	return res.Request.URL.String()
+}
+
+// dumpFeed writes the raw bytes of a feed that failed to parse, along with as
+// much of its node tree as could be decoded, to dir for later inspection.
+func dumpFeed(dir, feedURL string, raw []byte) error {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, feedURL)
+	if err := os.WriteFile(filepath.Join(dir, name+".raw"), raw, 0o644); err != nil {
+		return fmt.Errorf("writing raw feed: %w", err)
+	}
+	// The decode error is expected here, we only want whatever was decoded
+	// before it happened.
+	var root node
+	_ = unmarshal(raw, &root)
+	var tree bytes.Buffer
+	encoder := xml.NewEncoder(&tree)
+	encoder.Indent("", "  ")
+	if err := encodeTree(encoder, root); err != nil {
+		return fmt.Errorf("encoding node tree: %w", err)
+	}
+	if err := encoder.Flush(); err != nil {
+		return fmt.Errorf("encoding node tree: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".tree.xml"), tree.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing node tree: %w", err)
+	}
+	return nil
+}
+
+// encodeTree writes the element structure of n, including the text of leaf
+// elements. node.Content holds the raw inner XML of every element, so it is
+// only worth writing out where there are no child nodes to repeat it.
+func encodeTree(encoder *xml.Encoder, n node) error {
+	if n.XMLName.Local == "" {
+		return nil
+	}
+	start := xml.StartElement{Name: n.XMLName}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	if len(n.Nodes) == 0 {
+		if text := bytes.TrimSpace(n.Content); len(text) > 0 {
+			if err := encoder.EncodeToken(xml.CharData(text)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, child := range n.Nodes {
+		if err := encodeTree(encoder, child); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// hostname returns the host part of rawURL, or rawURL itself if it has none.
+func hostname(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return rawURL
+}
+
+// relativeTime describes how long before now t was, in the coarsest unit that
+// fits, e.g. "3h ago".
+func relativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < 0:
+		return "in the future"
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	case d < 365*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	default:
+		return fmt.Sprintf("%dy ago", int(d/(365*24*time.Hour)))
+	}
+}
+
+// writePreview prints the first n entries as plain text for a quick look from
+// a terminal.
+func writePreview(w io.Writer, entries []Entry, n int) error {
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if _, err := fmt.Fprintf(w, "%s\n  %s, %s\n  %s\n", entry.EntryTitle, entry.SourceTitle, relativeTime(entry.Time, now), entry.Link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logGenerators writes a summary of how many feeds were produced by each
+// generator, which helps spot software that tends to produce broken feeds.
+func logGenerators(generators map[string]int) {
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		label := name
+		if label == "" {
+			label = "(unknown)"
+		}
+		slog.Debug("generator summary", "generator", label, "feeds", generators[name])
+	}
+}
+
+// validateFeed fetches a single feed and writes a report of anything about it
+// that eris had to work around. It returns the exit status for the run, which
+// is non-zero only if the feed couldn't be fetched or parsed at all.
+func validateFeed(w io.Writer, client *http.Client, feedURL string) int {
+	feedURL, auth := splitCredentials(feedURL)
+	res, err := fetchFeed(context.Background(), client, feedURL, *feedTimeout, validators{}, auth)
+	if err != nil {
+		fmt.Fprintf(w, "error: fetching %s: %v\n", feedURL, err)
+		return 1
+	}
+	feed, err := parseFeed(res.url, res.body)
+	if err != nil {
+		fmt.Fprintf(w, "error: parsing %s: %v\n", feedURL, err)
+		return 1
+	}
+	var problems []string
+	for _, err := range feed.Skipped {
+		problems = append(problems, "skipped "+err.Error())
+	}
+	ids := make(map[string]int)
+	for _, entry := range feed.Entries {
+		if !entry.HasDate {
+			problems = append(problems, fmt.Sprintf("entry %q has no date", entry.EntryTitle))
+		}
+		if strings.TrimSpace(entry.Link) == "" {
+			problems = append(problems, fmt.Sprintf("entry %q has no link", entry.EntryTitle))
+		}
+		if strings.ContainsAny(entry.EntryTitle, "<>") {
+			problems = append(problems, fmt.Sprintf("entry %q has HTML markup in its title", entry.EntryTitle))
+		}
+		if entry.ID != "" {
+			ids[entry.ID]++
+		}
+	}
+	var duplicates []string
+	for id, n := range ids {
+		if n > 1 {
+			duplicates = append(duplicates, fmt.Sprintf("GUID %q is used by %d entries", id, n))
+		}
+	}
+	sort.Strings(duplicates)
+	problems = append(problems, duplicates...)
+
+	fmt.Fprintf(w, "%s: %d entries, generator %q\n", feedURL, len(feed.Entries), feed.Generator)
+	for _, problem := range problems {
+		fmt.Fprintf(w, "warning: %s\n", problem)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "no problems found")
+	}
+	return 0
+}
+
+// requestError is returned by fetchFeed when no response was received at all,
+// usually because the server is temporarily unreachable.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+func (e *requestError) Unwrap() error { return e.err }
+
+// statusError is returned by fetchFeed when the server responds with anything
+// other than 200 OK.
+type statusError struct {
+	code   int
+	status string
+	// retryAfter is how long the server asked us to wait before trying again,
+	// if it did.
+	retryAfter    time.Duration
+	hasRetryAfter bool
+}
+
+func (e *statusError) Error() string { return "non-OK status code: " + e.status }
+
+var errNotModified = errors.New("not modified")
+
+// fetched is a successfully downloaded feed.
+type fetched struct {
+	body       []byte
+	validators validators
+	// contentType is the media type of the response, without parameters.
+	contentType string
+	// url is where the feed was finally fetched from, after any redirects.
+	url string
+	// expires is when the server says the feed may have changed, if it
+	// said. See freshUntil.
+	expires time.Time
+	// elapsed is how long the server took to send the feed, without any
+	// time spent waiting to be let through to it. See roundTripTimer.
+	elapsed time.Duration
+}
+
+// fetchFeed downloads the feed at url, giving up after timeout. If cached holds
+// validators from an earlier fetch the request is made conditional, and
+// errNotModified is returned if the feed hasn't changed.
+func fetchFeed(ctx context.Context, client *http.Client, url string, timeout time.Duration, cached validators, auth credentials) (fetched, error) {
+	ctx, err := waitTurn(ctx, client, url)
+	if err != nil {
+		return fetched{}, err
+	}
+	// The deadline has to cover reading the body as well, so only cancel once
+	// we're done with the response.
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var timer roundTripTimer
+	req, err := http.NewRequestWithContext(timer.trace(ctx), "GET", url, nil)
+	if err != nil {
+		return fetched{}, fmt.Errorf("creating request: %w", err)
+	}
+	addIdentity(req)
+	auth.set(req)
+	req.Header.Set("Accept", feedAccept)
+	// Asking for compression ourselves stops the transport decompressing
+	// gzip transparently, but lets us handle deflate too. See decodeBody.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if cached.ETag != "" {
+		req.Header.Add("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Add("If-Modified-Since", cached.LastModified)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fetched{}, &requestError{err: err}
+	}
+	received := time.Now()
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			slog.Error("error closing response body", "url", url, "err", err)
+		}
+	}()
+	if res.StatusCode == http.StatusNotModified {
+		return fetched{validators: cached, expires: freshUntil(res.Header, time.Now()), elapsed: timer.total}, errNotModified
+	}
+	if res.StatusCode != http.StatusOK {
+		statusErr := &statusError{code: res.StatusCode, status: res.Status}
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+			statusErr.retryAfter, statusErr.hasRetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		}
+		return fetched{}, statusErr
+	}
+	rawFeed, err := readLimited(res.Body, *maxBody)
+	if err != nil {
+		return fetched{}, fmt.Errorf("reading body: %w", err)
+	}
+	rawFeed, err = decodeBody(res.Header.Get("Content-Encoding"), rawFeed, *maxBody)
+	if err != nil {
+		return fetched{}, fmt.Errorf("decompressing body: %w", err)
+	}
+	rawFeed = toUTF8(rawFeed, res.Header.Get("Content-Type"))
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if final := res.Request.URL.String(); final != url {
+		slog.Debug("followed redirects", "url", url, "final", final)
+	}
+	return fetched{
+		body: rawFeed,
+		validators: validators{
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+		},
+		contentType: contentType,
+		url:         res.Request.URL.String(),
+		expires:     freshUntil(res.Header, time.Now()),
+		elapsed:     timer.total + time.Since(received),
+	}, nil
+}
+
+// freshUntil returns when a response with header, received at now, stops
+// being fresh according to its Cache-Control or Expires headers. It returns
+// the zero time if the response shouldn't be reused without asking again.
+func freshUntil(header http.Header, now time.Time) time.Time {
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return time.Time{}
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+				maxAge = seconds
+			}
+		}
+	}
+	if maxAge >= 0 {
+		// Age is how long the response has already spent in caches on
+		// the way to us.
+		age, _ := strconv.Atoi(header.Get("Age"))
+		return now.Add(time.Duration(maxAge-age) * time.Second)
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires
+	}
+	return time.Time{}
+}
+
+// retriesExhaustedError wraps the last error from a fetch that kept failing
+// until it ran out of retries.
+type retriesExhaustedError struct {
+	attempts int
+	err      error
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("giving up after %d attempts: %v", e.attempts, e.err)
+}
+
+func (e *retriesExhaustedError) Unwrap() error { return e.err }
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, capping the delay at maxRetryAfter.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		delay = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		delay = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
+}
+
+// probeFeed makes a conditional HEAD request for url and reports whether the
+// feed is unchanged since cached was stored, and if so when it next expires.
+// Servers that don't support HEAD, or that fail in any other way, report a
+// change so that the caller falls back to a full GET.
+func probeFeed(ctx context.Context, client *http.Client, url string, timeout time.Duration, cached validators, auth credentials) (time.Time, bool) {
+	ctx, err := waitTurn(ctx, client, url)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return time.Time{}, false
+	}
+	addIdentity(req)
+	auth.set(req)
+	req.Header.Set("Accept", feedAccept)
+	if cached.ETag != "" {
+		req.Header.Add("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Add("If-Modified-Since", cached.LastModified)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		slog.Debug("HEAD probe failed", "url", url, "err", err)
+		return time.Time{}, false
+	}
+	if err := res.Body.Close(); err != nil {
+		slog.Error("error closing HEAD response body", "url", url, "err", err)
+	}
+	expires := freshUntil(res.Header, time.Now())
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		return expires, true
+	case res.StatusCode != http.StatusOK:
+		slog.Debug("HEAD probe not supported", "url", url, "status", res.Status)
+		return time.Time{}, false
+	}
+	// Some servers answer HEAD in full whatever the conditions, but still
+	// give the validators, which say just as well whether anything changed.
+	if etag := res.Header.Get("ETag"); etag != "" || cached.ETag != "" {
+		return expires, etag == cached.ETag
+	}
+	lastModified := res.Header.Get("Last-Modified")
+	return expires, lastModified != "" && lastModified == cached.LastModified
+}
+
+// fetchWithRetries calls fetchFeed, retrying with exponential backoff after
+// failures that might go away on their own. A server that says how long to
+// wait with Retry-After gets one extra retry after that long.
+func fetchWithRetries(ctx context.Context, client *http.Client, url string, timeout time.Duration, cached validators, auth credentials) (fetched, error) {
+	backoff := retryBackoff
+	retried, waited := 0, false
+	for attempt := 1; ; attempt++ {
+		res, err := fetchFeed(ctx, client, url, timeout, cached, auth)
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.hasRetryAfter && !waited {
+			waited = true
+			slog.Debug("server asked us to retry later", "url", url, "after", statusErr.retryAfter)
+			if !sleep(ctx, statusErr.retryAfter) {
+				return res, err
+			}
+			continue
+		}
+		if !retryable(err) {
+			return res, err
+		}
+		if retried >= *retries {
+			if attempt > 1 {
+				err = &retriesExhaustedError{attempts: attempt, err: err}
+			}
+			return res, err
+		}
+		retried++
+		if !sleep(ctx, backoff) {
+			return res, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleep waits for d, returning false early if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryable reports whether err is worth retrying. Network errors and server
+// errors are often temporary, client errors and redirect loops aren't.
+func retryable(err error) bool {
+	var reqErr *requestError
+	var statusErr *statusError
+	switch {
+	case err == nil, errors.Is(err, errTooManyRedirects):
+		return false
+	case errors.As(err, &reqErr):
+		return true
+	case errors.As(err, &statusErr):
+		return statusErr.code >= 500
+	default:
+		return false
+	}
+}
+
+// addIdentity sets the headers that identify eris to the servers it fetches
+// from.
+func addIdentity(req *http.Request) {
+	agent := *userAgent
+	if agent == "" {
+		agent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", agent)
+	if *from != "" {
+		req.Header.Set("From", *from)
+	}
+}
+
+func isHTML(contentType string) bool {
+	return contentType == "text/html" || contentType == "application/xhtml+xml"
+}
+
+// isHTMLDocument reports whether body starts like an HTML page rather than a
+// feed, with a doctype or html element.
+func isHTMLDocument(body []byte) bool {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	body = bytes.TrimLeft(body, " \t\r\n")
+	for _, prefix := range []string{"<!doctype html", "<html"} {
+		if len(body) >= len(prefix) && strings.EqualFold(string(body[:len(prefix)]), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverFeed finds the feed an HTML page advertises with a
+// <link rel="alternate"> element, resolved against base.
+func discoverFeed(base string, body []byte) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("parsing base URL: %w", err)
+	}
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return "", err
+			}
+			return "", errors.New("no feed advertised")
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom.String() {
+			case "base":
+				// A <base> element changes what relative links are
+				// relative to.
+				if href := attr(token, "href"); href != "" {
+					if u, err := baseURL.Parse(href); err == nil {
+						baseURL = u
+					}
+				}
+			case "link":
+				rel := strings.Fields(strings.ToLower(attr(token, "rel")))
+				mediaType := strings.ToLower(strings.TrimSpace(attr(token, "type")))
+				href := attr(token, "href")
+				if !contains(rel, "alternate") || href == "" {
+					continue
+				}
+				if mediaType != "application/rss+xml" && mediaType != "application/atom+xml" {
+					continue
+				}
+				feedURL, err := baseURL.Parse(href)
+				if err != nil {
+					return "", fmt.Errorf("parsing advertised feed URL: %w", err)
+				}
+				return feedURL.String(), nil
+			}
+		}
+	}
+}
+
+func attr(token html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverAndParse follows the feed advertised by the HTML page in page and
+// parses it. Only one level of discovery is tried, so a feed URL that leads to
+// yet another page is an error rather than a loop. auth is only sent on to a
+// feed on the same host as the page.
+func discoverAndParse(ctx context.Context, client *http.Client, page fetched, timeout time.Duration, auth credentials) (Feed, error) {
+	feedURL, err := discoverFeed(page.url, page.body)
+	if err != nil {
+		return Feed{}, fmt.Errorf("discovering feed in HTML page: %w", err)
+	}
+	slog.Debug("HTML page found, trying advertised feed", "url", page.url, "feed", feedURL)
+	if !strings.EqualFold(hostname(page.url), hostname(feedURL)) {
+		auth = credentials{}
+	}
+	res, err := fetchWithRetries(ctx, client, feedURL, timeout, validators{}, auth)
+	if err != nil {
+		return Feed{}, fmt.Errorf("fetching discovered feed %q: %w", feedURL, err)
+	}
+	feed, err := parseFeed(res.url, res.body)
+	if err != nil {
+		return Feed{}, fmt.Errorf("parsing discovered feed %q: %w", feedURL, err)
+	}
+	return feed, nil
+}
+
+var errBodyTooLarge = errors.New("body too large")
+
+// readLimited reads all of r, failing with errBodyTooLarge rather than reading
+// more than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errBodyTooLarge, limit)
+	}
+	return body, nil
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decodeBody undoes the Content-Encoding of a response body. Some servers
+// send gzipped feeds without saying so, so gzip is also detected by its magic
+// number. Decompressed bodies larger than limit are rejected.
+func decodeBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, but plenty of servers send
+		// a raw deflate stream instead.
+		z, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		} else {
+			r = z
+		}
+	default:
+		if !bytes.HasPrefix(body, gzipMagic) {
+			return body, nil
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, nil
+		}
+		r = gz
+	}
+	// A small compressed body can still expand to something huge.
+	return readLimited(r, limit)
+}
+
+// toUTF8 converts a body that isn't valid UTF-8, and doesn't declare some
+// other encoding for the XML decoder to handle, to UTF-8. Plenty of feeds are
+// really in Windows-1252 while claiming to be UTF-8, or not saying, which the
+// decoders would otherwise reject or turn into replacement characters. The
+// charset from contentType is used if it gives one other than UTF-8, and
+// Windows-1252 otherwise, which also covers Latin-1.
+func toUTF8(body []byte, contentType string) []byte {
+	if utf8.Valid(body) {
+		return body
+	}
+	if _, name := lookupCharset(xmlEncoding(body)); name != "" && name != "utf-8" {
+		return body
+	}
+	var enc encoding.Encoding = charmap.Windows1252
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if e, name := lookupCharset(params["charset"]); e != nil && name != "utf-8" {
+			enc = e
+		}
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// xmlEncoding returns the encoding given in the XML declaration at the start
+// of doc, if any.
+func xmlEncoding(doc []byte) string {
+	doc = bytes.TrimLeftFunc(bytes.TrimPrefix(bytes.TrimLeftFunc(doc, unicode.IsSpace), utf8BOM), unicode.IsSpace)
+	if !bytes.HasPrefix(doc, []byte("<?xml")) {
+		return ""
+	}
+	decl, _, ok := bytes.Cut(doc, []byte("?>"))
+	if !ok {
+		return ""
+	}
+	_, value, ok := bytes.Cut(decl, []byte("encoding="))
+	if !ok || len(value) == 0 {
+		return ""
+	}
+	quote := value[0]
+	if quote != '"' && quote != '\'' {
+		return ""
+	}
+	name, _, ok := bytes.Cut(value[1:], []byte{quote})
+	if !ok {
+		return ""
+	}
+	return string(name)
+}
+
+// logFetchError logs why a feed couldn't be fetched, unless it is the sort of
+// temporary failure that would only clog up the logs.
+func logFetchError(url string, err error) {
+	var reqErr *requestError
+	var statusErr *statusError
+	var exhaustedErr *retriesExhaustedError
+	var parseErr *parseError
+	switch {
+	case errors.As(err, &exhaustedErr):
+		// Having retried, this is more than a server briefly going offline.
+		slog.Warn("error fetching feed", "url", url, "err", err)
+	case errors.Is(err, errTooManyRedirects):
+		// Redirect loops won't fix themselves, so they're worth reporting.
+		slog.Warn("too many redirects", "url", url, "err", err)
+	case errors.Is(err, errBodyTooLarge):
+		slog.Warn("skipping oversized feed", "url", url, "err", err)
+	case errors.Is(err, errDisallowed):
+		slog.Info("skipping feed disallowed by robots.txt", "url", url)
+	case errors.As(err, &parseErr):
+		slog.Error("error gathering feed entries", "url", url, "err", parseErr.err)
+	case errors.As(err, &reqErr):
+		// Other HTTP errors only clog up logs when servers temporarily go
+		// offline, so keep them out of sight unless asked.
+		slog.Debug("error fetching feed", "url", url, "err", err)
+	case errors.As(err, &statusErr):
+		slog.Warn("non-OK status code", "url", url, "code", statusErr.code, "status", statusErr.status)
+	default:
+		slog.Error("error fetching feed", "url", url, "err", err)
+	}
+}
+
+// describeFetchError sums up why a feed failed, for the -validate report.
+func describeFetchError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var statusErr *statusError
+	var parseErr *parseError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "DNS lookup failed: " + dnsErr.Error()
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timed out: " + err.Error()
+	case errors.As(err, &statusErr):
+		return "non-OK status: " + statusErr.status
+	case errors.Is(err, errTooManyRedirects):
+		return "too many redirects: " + err.Error()
+	case errors.Is(err, errUnknownFeedType):
+		return "unknown feed type"
+	case errors.As(err, &parseErr):
+		return "parse error: " + parseErr.err.Error()
+	default:
+		return err.Error()
+	}
+}
+
+// newClient returns the client used for every request. hostLimits gives
+// hosts that need fewer requests in flight than -conns-per-host allows, and
+// proxy picks the proxy for each request, as for http.Transport.
+func newClient(hostLimits map[string]int, proxy func(*http.Request) (*url.URL, error)) *http.Client {
+	// The connect timeout only bounds dialing. The per-request deadline
+	// still covers the whole request, so a connect timeout longer than it has
+	// no effect.
+	dialer := &net.Dialer{
+		Timeout:   *connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext:     dialer.DialContext,
+		Proxy:           proxy,
+		MaxConnsPerHost: *maxConnsPerHost,
+		// Many feeds on one host can reuse connections between them if
+		// enough are kept idle.
+		MaxIdleConnsPerHost: *maxIdleConns,
+		IdleConnTimeout:     *idleTimeout,
+		// Setting DialContext turns off HTTP/2 unless it is asked for.
+		ForceAttemptHTTP2: true,
+	}
+	if *http1Only {
+		// Some load balancers mishandle HTTP/2 and return truncated bodies or
+		// RST_STREAM errors. A non-nil, empty TLSNextProto map is the
+		// documented way to stop the transport negotiating HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		slog.Debug("HTTP/2 disabled")
+	}
+	// Timeouts are applied per request with a context rather than through
+	// client.Timeout so that feeds can override them.
+	var roundTripper http.RoundTripper = transport
+	if len(hostLimits) > 0 {
+		roundTripper = newHostLimitTransport(transport, hostLimits)
+	}
+	if *requestRate > 0 {
+		// Wait for the rate limit before taking a connection slot, so that a
+		// waiting request doesn't hold one.
+		roundTripper = newRateLimitTransport(roundTripper, rate.Limit(*requestRate), hostBurst)
+	}
+	return &http.Client{
+		Transport: roundTripper,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= *maxRedirects {
+				return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, len(via))
+			}
+			// Headers are copied to the redirected request, but set ours
+			// again in case the copying rules ever drop them.
+			addIdentity(req)
+			return nil
+		},
+	}
+}
+
+// useOutputCache saves entries to the output cache at path, or if there are
+// none, marks agg as stale and returns the entries from the last run that did
+// find some. Being offline is then no worse than showing old entries.
+func useOutputCache(agg *Aggregator, path string, entries []Entry) []Entry {
+	if len(entries) > 0 {
+		if err := saveOutput(path, entries); err != nil {
+			slog.Error("error saving output cache", "path", path, "err", err)
+		}
+		return entries
+	}
+	last, err := loadOutput(path)
+	if err != nil {
+		slog.Error("error loading output cache", "path", path, "err", err)
+		return entries
+	}
+	if len(last.Entries) == 0 {
+		return entries
+	}
+	slog.Warn("no entries collected, outputting those from an earlier run", "from", last.Time)
+	agg.Stale = last.Time
+	return last.Entries
+}
+
+// saveState saves what agg has learned about the feeds, for the next run.
+func saveState(agg *Aggregator) {
+	if *cachePath != "" {
+		if err := agg.Cache.save(*cachePath); err != nil {
+			slog.Error("error saving cache", "path", *cachePath, "err", err)
+		}
+	}
+	if *latencyPath != "" {
+		if err := agg.Latencies.save(*latencyPath); err != nil {
+			slog.Error("error saving host latencies", "path", *latencyPath, "err", err)
+		}
+	}
+}
+
+func main() {
+	start := time.Now()
+	flag.Parse()
+	if *configPath != "" {
+		f, err := os.Open(*configPath)
+		if err != nil {
+			fmt.Printf("Could not open file %q: %v\n", *configPath, err)
+			os.Exit(1)
+		}
+		settings, err := parseConfig(f)
+		f.Close()
+		if err == nil {
+			err = applyConfig(flag.CommandLine, settings)
+		}
+		if err != nil {
+			fmt.Printf("Could not read config file %q: %v\n", *configPath, err)
+			os.Exit(1)
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Printf("Unknown log level %q.\n", *logLevel)
+		os.Exit(1)
+	}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	// Header values can't span lines; letting one through would allow
+	// arbitrary headers to be injected into every request.
+	if strings.ContainsAny(*userAgent, "\r\n") || strings.ContainsAny(*from, "\r\n") {
+		fmt.Println("The -user-agent and -from values must not contain line breaks.")
+		os.Exit(1)
+	}
+	var hostLimits map[string]int
+	if *hostLimitsPath != "" {
+		f, err := os.Open(*hostLimitsPath)
+		if err != nil {
+			fmt.Printf("Could not open file %q: %v\n", *hostLimitsPath, err)
+			os.Exit(1)
+		}
+		hostLimits, err = parseHostLimits(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("Could not parse host limits: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	proxy := http.ProxyFromEnvironment
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Printf("Invalid proxy URL %q.\n", *proxyURL)
+			os.Exit(1)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	client := newClient(hostLimits, proxy)
+	if *validateURL != "" {
+		os.Exit(validateFeed(os.Stdout, client, *validateURL))
+	}
+	if flag.NArg() < 1 {
+		fmt.Println("Please specify an opml file to read feeds from.")
+		os.Exit(1)
+	}
+	if *serveAddr != "" && *interval <= 0 {
+		fmt.Println("The -interval must be positive.")
+		os.Exit(1)
+	}
+	if _, ok := faviconServices[*favicons]; !ok {
+		fmt.Printf("Unknown favicon service %q.\n", *favicons)
+		os.Exit(1)
+	}
+	switch *format {
+	case "html", "atom", "rss", "text", "json", "mbox":
+	default:
+		fmt.Printf("Unknown output format %q.\n", *format)
+		os.Exit(1)
+	}
+	// Parse the template up front so that mistakes in it show up before
+	// waiting on any feeds.
+	var agg *Aggregator
+	funcs := template.FuncMap{
+		"stale": func() string { return agg.stale() },
+		"lang":  func() string { return *lang },
+	}
+	tmpl, err := template.New("feeds").Funcs(funcs).Parse(feedTmpl)
+	if *templatePath != "" {
+		tmpl, err = template.New(filepath.Base(*templatePath)).Funcs(funcs).ParseFiles(*templatePath)
+	}
+	if err != nil {
+		fmt.Printf("Could not parse template: %v\n", err)
+		os.Exit(1)
+	}
+	var feeds []feedSource
+	for _, name := range flag.Args() {
+		fileFeeds, err := readOPML(name)
+		if err != nil {
+			fmt.Printf("Could not read OPML file %q: %v\n", name, err)
+			os.Exit(1)
+		}
+		feeds = append(feeds, fileFeeds...)
+	}
+	feeds = uniqueFeeds(feeds)
+	categoryOverrides, err := parseCategoryLimits(categoryLimits)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(opmlCategories) > 0 {
+		feeds = filterCategories(feeds, opmlCategories)
+		slog.Info("selected feeds by category", "feeds", len(feeds), "categories", opmlCategories.String())
+	}
+	if len(includeFeeds) > 0 || len(excludeFeeds) > 0 {
+		feeds = filterFeeds(feeds, includeFeeds, excludeFeeds)
+		slog.Info("selected feeds by URL", "feeds", len(feeds))
+	}
+	if *listFeeds {
+		for _, feed := range feeds {
+			fmt.Println(feed.URL)
+		}
+		return
+	}
+
+	var cache *feedCache
+	if *cachePath != "" {
+		cache, err = loadCache(*cachePath)
+		if err != nil {
+			// A broken cache only costs bandwidth, so carry on without it.
+			slog.Error("error loading cache", "path", *cachePath, "err", err)
+		}
+	}
+
+	agg = &Aggregator{
+		Client:         client,
+		Cache:          cache,
+		FeedTimeout:    *feedTimeout,
+		Force:          *force,
+		HeadProbe:      *headProbe,
+		Concurrency:    *concurrency,
+		Merge:          *mergeFields,
+		DedupTitles:    *dedupTitlesFlag,
+		Limit:          *limit,
+		PerFeed:        *perFeedLimit,
+		PerCategory:    *perCategory,
+		CategoryLimits: categoryOverrides,
+		Since:          *since,
+		IncludeTags:    includeTags,
+		ExcludeTags:    excludeTags,
+		DBPath:         *dbPath,
+		DumpDir:        *dumpDir,
+		SeenPath:       *seenPath,
+		Format:         *format,
+		Preview:        *preview,
+		Pretty:         *pretty,
+		Template:       tmpl,
+	}
+	if *resolveLinks {
+		agg.Resolver = newLinkResolver(client)
+	}
+	if *respectRobots {
+		agg.Robots = newRobotsChecker(client, *feedTimeout)
+	}
+	if *timeoutPerHost {
+		agg.Latencies, err = loadLatencies(*latencyPath)
+		if err != nil {
+			// Like the cache, this only helps, so carry on without it.
+			slog.Error("error loading host latencies", "path", *latencyPath, "err", err)
+		}
+	}
+
+	// When the deadline passes or we're interrupted every outstanding
+	// request is cancelled, so Fetch returns with whatever has been
+	// collected by then.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A server applies the deadline to each refresh instead.
+	if *deadline > 0 && *serveAddr == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	if *validateAll {
+		status := agg.Validate(ctx, os.Stdout, feeds)
+		stop()
+		os.Exit(status)
+	}
+
+	if *reportHubs {
+		if err := agg.ReportHubs(ctx, os.Stdout, feeds); err != nil {
+			slog.Error("error writing hub report", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *exportOPML {
+		if err := agg.ExportOPML(ctx, os.Stdout, feeds); err != nil {
+			slog.Error("error writing opml", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *serveAddr != "" {
+		s := &server{
+			agg:        agg,
+			feeds:      feeds,
+			deadline:   *deadline,
+			minEntries: *minEntries,
+			saved:      func() { saveState(agg) },
+		}
+		if err := s.run(ctx, *serveAddr, *interval); err != nil {
+			slog.Error("error serving feeds", "addr", *serveAddr, "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	entries := agg.Fetch(ctx, feeds)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		slog.Warn("deadline reached, outputting the entries collected so far", "deadline", *deadline)
+	case ctx.Err() != nil:
+		slog.Warn("interrupted, outputting the entries collected so far")
+	}
+	// Let another interrupt kill us if writing the output hangs.
+	stop()
+
+	saveState(agg)
+
+	// Checked before the output cache is updated, so that a poor run can't
+	// replace the last good one there either.
+	if len(entries) < *minEntries {
+		slog.Error("too few entries, leaving the output alone", "entries", len(entries), "min", *minEntries)
+		os.Exit(1)
+	}
+
+	if *outputCache != "" {
+		entries = useOutputCache(agg, *outputCache, entries)
+	}
+
+	if *outputPath == "" {
+		err = agg.Render(os.Stdout, entries)
+	} else {
+		err = writeFileAtomic(*outputPath, 0o644, func(w io.Writer) error {
+			return agg.Render(w, entries)
+		})
+	}
+	if err != nil {
+		slog.Error("error writing output", "err", err)
+		os.Exit(1)
+	}
+	if *showStats {
+		// Written directly rather than logged so that it appears whatever
+		// the log level, for cron jobs to pick up.
+		s := agg.Stats
+		fmt.Fprintf(os.Stderr, "feeds=%d fetched=%d failed=%d entries=%d duplicates=%d elapsed=%s\n",
+			s.Feeds, s.Fetched, s.Failed, s.Entries, s.Duplicates, time.Since(start).Round(time.Millisecond))
 	}
 }
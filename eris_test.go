@@ -0,0 +1,972 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFeed is a minimal RSS feed with a single entry.
+const testFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test</title>
+<item><title>One</title><link>http://example.com/1</link><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+func TestEntrySetKeepsFirstListedDuplicate(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var entries []Entry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, Entry{
+			EntryTitle:  "Shared",
+			Link:        "http://example.com/shared",
+			Time:        day,
+			HasDate:     true,
+			FeedURL:     fmt.Sprintf("http://example.com/f%d", i),
+			SourceTitle: fmt.Sprintf("f%d", i),
+			feedOrder:   i,
+		})
+	}
+	for _, merge := range []bool{false, true} {
+		for run := 0; run < 20; run++ {
+			rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+			set := newEntrySet(merge)
+			for _, entry := range entries {
+				set.add(entry)
+			}
+			got := set.list()
+			if len(got) != 1 || got[0].SourceTitle != "f0" {
+				t.Fatalf("merge %v: kept %+v, want only the entry from f0", merge, got)
+			}
+		}
+	}
+}
+
+func TestEntryRuntimeAndSize(t *testing.T) {
+	for _, test := range []struct {
+		duration time.Duration
+		want     string
+	}{
+		{0, ""},
+		{30 * time.Second, "30 s"},
+		{45*time.Minute + 10*time.Second, "45 min"},
+		{2 * time.Hour, "2 h"},
+		{time.Hour + 5*time.Minute, "1 h 5 min"},
+	} {
+		if got := (Entry{Duration: test.duration}).Runtime(); got != test.want {
+			t.Errorf("Runtime of %v got %q, want %q", test.duration, got, test.want)
+		}
+	}
+	for _, test := range []struct {
+		length, want string
+	}{
+		{"", ""},
+		{"nonsense", ""},
+		{"0", ""},
+		{"512", "512 B"},
+		{"1500", "1.5 kB"},
+		{" 62000000 ", "62 MB"},
+		{"1234567890", "1.2 GB"},
+	} {
+		if got := (Entry{Enclosure: Enclosure{Length: test.length}}).Size(); got != test.want {
+			t.Errorf("Size of %q got %q, want %q", test.length, got, test.want)
+		}
+	}
+}
+
+func TestParseJSONFeedEscapesText(t *testing.T) {
+	const feed = `{
+		"version": "https://jsonfeed.org/version/1.1",
+		"title": "JSON",
+		"items": [
+			{"id": "1", "url": "http://example.com/1", "title": "Text", "content_text": "a < b & <i>not</i> markup", "date_published": "2024-01-02T00:00:00Z"},
+			{"id": "2", "url": "http://example.com/2", "title": "HTML", "content_html": "<p>1 &lt; 2</p>", "date_modified": "2024-01-01T00:00:00Z"}
+		]
+	}`
+	got, err := parseFeed("http://example.com/feed.json", []byte(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got.Entries))
+	}
+	if want := "a &lt; b &amp; &lt;i&gt;not&lt;/i&gt; markup"; got.Entries[0].Description != want {
+		t.Errorf("got description %q, want %q", got.Entries[0].Description, want)
+	}
+	if want := "a < b & <i>not</i> markup"; got.Entries[0].Summary() != want {
+		t.Errorf("got summary %q, want %q", got.Entries[0].Summary(), want)
+	}
+	if want := "1 &lt; 2"; got.Entries[1].Description != want {
+		t.Errorf("got description %q, want %q", got.Entries[1].Description, want)
+	}
+	if !got.Entries[1].Time.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got time %v, want date_modified", got.Entries[1].Time)
+	}
+}
+
+func TestParseRSSIgnoresAtomLinkInItem(t *testing.T) {
+	const feed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Test</title>
+<atom:link rel="self" href="http://example.com/feed.xml"/>
+<item><title>One</title><link>http://example.com/1</link><atom:link rel="self" href="http://example.com/1.xml"/></item>
+<item><title>Two</title><atom:link rel="self" href="http://example.com/2.xml"/><link>http://example.com/2</link></item>
+</channel></rss>`
+	got, err := parseFeed("http://example.com/feed.xml", []byte(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got.Entries))
+	}
+	for i, want := range []string{"http://example.com/1", "http://example.com/2"} {
+		if got.Entries[i].Link != want {
+			t.Errorf("entry %d got link %q, want %q", i, got.Entries[i].Link, want)
+		}
+	}
+	if got.SelfURL != "http://example.com/feed.xml" {
+		t.Errorf("got self URL %q", got.SelfURL)
+	}
+}
+
+func TestMergeEntries(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	older := Entry{
+		EntryTitle:  "Episode",
+		Link:        "http://example.com/1",
+		Description: "Old description",
+		Time:        day,
+		HasDate:     true,
+		Author:      "Someone",
+		Categories:  []string{"Go"},
+		Enclosure:   Enclosure{URL: "http://example.com/1.mp3"},
+		Duration:    time.Hour,
+		ImageURL:    "http://example.com/1.jpg",
+		SourceTitle: "Podcast",
+	}
+	newer := Entry{
+		EntryTitle:  "Episode, edited",
+		Link:        "http://example.com/1",
+		Time:        day.Add(time.Hour),
+		HasDate:     true,
+		Description: "New description",
+	}
+	for _, got := range []Entry{mergeEntries(older, newer), mergeEntries(newer, older)} {
+		want := older
+		want.EntryTitle = newer.EntryTitle
+		want.Description = newer.Description
+		want.Time = newer.Time
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got\n%+v\nwant\n%+v", got, want)
+		}
+	}
+}
+
+// mustParse parses feed, fetched from base, failing the test if it can't.
+func mustParse(t *testing.T, base, feed string) Feed {
+	t.Helper()
+	got, err := parseFeed(base, []byte(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestParseGenerator(t *testing.T) {
+	for _, test := range []struct {
+		name, feed, want string
+	}{
+		{"rss", `<rss version="2.0"><channel><title>T</title><generator> WordPress 6.4 </generator></channel></rss>`, "WordPress 6.4"},
+		{"atom", `<feed xmlns="http://www.w3.org/2005/Atom"><title>T</title><generator uri="https://gohugo.io" version="0.120">Hugo</generator></feed>`, "Hugo 0.120"},
+		{"none", `<rss version="2.0"><channel><title>T</title></channel></rss>`, ""},
+	} {
+		if got := mustParse(t, "", test.feed).Generator; got != test.want {
+			t.Errorf("%s: got generator %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseSkipsBadEntries(t *testing.T) {
+	for _, test := range []struct {
+		name, feed string
+	}{
+		{"rss", `<rss version="2.0"><channel><title>T</title>
+<item><title>Good</title><link>http://example.com/1</link><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Bad date</title><link>http://example.com/2</link><pubDate>the other day</pubDate></item>
+<item><title>Bad link</title><link>http://example.com/%zz</link><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Undated</title><link>http://example.com/4</link></item>
+</channel></rss>`},
+		{"atom", `<feed xmlns="http://www.w3.org/2005/Atom"><title>T</title>
+<entry><title>Good</title><link href="http://example.com/1"/><updated>2024-01-01T10:00:00Z</updated></entry>
+<entry><title>Bad date</title><link href="http://example.com/2"/><updated>the other day</updated></entry>
+<entry><title>Bad link</title><link href="http://example.com/%zz"/><updated>2024-01-01T10:00:00Z</updated></entry>
+<entry><title>Undated</title><link href="http://example.com/4"/></entry>
+</feed>`},
+	} {
+		got := mustParse(t, "", test.feed)
+		var titles []string
+		for _, entry := range got.Entries {
+			titles = append(titles, entry.EntryTitle)
+		}
+		if want := []string{"Good", "Undated"}; !reflect.DeepEqual(titles, want) {
+			t.Errorf("%s: got entries %q, want %q", test.name, titles, want)
+		}
+		if len(got.Skipped) != 2 {
+			t.Errorf("%s: got %d skipped, want 2: %v", test.name, len(got.Skipped), got.Skipped)
+		}
+		if len(got.Entries) == 2 && (!got.Entries[0].HasDate || got.Entries[1].HasDate) {
+			t.Errorf("%s: only the first entry should be dated", test.name)
+		}
+	}
+}
+
+func TestParseStructuralErrors(t *testing.T) {
+	for _, feed := range []string{"", "not a feed", "<html><body>page</body></html>", `{"items": [`} {
+		if _, err := parseFeed("", []byte(feed)); err == nil {
+			t.Errorf("parsing %q succeeded, want an error", feed)
+		}
+	}
+}
+
+func TestParseOPMLTimeout(t *testing.T) {
+	const doc = `<opml version="2.0" xmlns:eris="https://github.com/admacleod/eris"><body>
+<outline type="rss" xmlUrl="http://example.com/slow.xml" eris:timeout="1m"/>
+<outline type="rss" xmlUrl="http://example.com/fast.xml"/>
+<outline type="rss" xmlUrl="http://example.com/bad.xml" eris:timeout="soon"/>
+</body></opml>`
+	feeds, err := parseOPMLBytes([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{time.Minute, 0, 0}
+	if len(feeds) != len(want) {
+		t.Fatalf("got %d feeds, want %d", len(feeds), len(want))
+	}
+	for i, feed := range feeds {
+		if feed.Timeout != want[i] {
+			t.Errorf("%s: got timeout %v, want %v", feed.URL, feed.Timeout, want[i])
+		}
+	}
+}
+
+func TestParseNormalizesTitles(t *testing.T) {
+	const nfc, nfd = "Caf\u00e9 notes", "Cafe\u0301 notes"
+	feed := `<rss version="2.0"><channel><title>T</title>
+<item><title>` + nfc + `</title><link>http://example.com/1</link><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>` + nfd + `</title><link>http://example.com/2</link><pubDate>Mon, 01 Jan 2024 09:00:00 GMT</pubDate></item>
+</channel></rss>`
+	got := mustParse(t, "", feed)
+	if len(got.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got.Entries))
+	}
+	for _, entry := range got.Entries {
+		if entry.EntryTitle != nfc {
+			t.Errorf("got title %q, want %q", entry.EntryTitle, nfc)
+		}
+	}
+	if deduped := dedupTitles(got.Entries); len(deduped) != 1 {
+		t.Errorf("got %d entries after deduplicating titles, want 1", len(deduped))
+	}
+}
+
+// compress returns data compressed with the named Content-Encoding, with
+// "raw deflate" for the deflate stream that some servers send unwrapped.
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchDecompresses(t *testing.T) {
+	for _, test := range []struct {
+		name, encoding, header string
+	}{
+		{"gzip", "gzip", "gzip"},
+		{"deflate", "deflate", "deflate"},
+		{"raw deflate", "raw deflate", "deflate"},
+		{"unlabelled gzip", "gzip", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := compress(t, test.encoding, []byte(testFeed))
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Accept-Encoding"); got != "gzip, deflate" {
+					t.Errorf("got Accept-Encoding %q", got)
+				}
+				if test.header != "" {
+					w.Header().Set("Content-Encoding", test.header)
+				}
+				w.Write(body)
+			}))
+			defer srv.Close()
+
+			res, err := fetchFeed(context.Background(), srv.Client(), srv.URL, time.Second, validators{}, credentials{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			feed := mustParse(t, res.url, string(res.body))
+			if len(feed.Entries) != 1 || feed.Entries[0].EntryTitle != "One" {
+				t.Errorf("got entries %+v", feed.Entries)
+			}
+		})
+	}
+}
+
+func TestFetchAsksForFeeds(t *testing.T) {
+	var accept string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	if _, err := fetchFeed(context.Background(), srv.Client(), srv.URL, time.Second, validators{}, credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	offered := make(map[string]bool)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		offered[strings.TrimSpace(mediaRange)] = true
+	}
+	for _, want := range []string{"application/atom+xml", "application/rss+xml", "application/xml;q=0.9", "*/*;q=0.8"} {
+		if !offered[want] {
+			t.Errorf("got Accept %q, want it to offer %s", accept, want)
+		}
+	}
+}
+
+func TestParseOPMLOutlines(t *testing.T) {
+	const doc = `<opml version="1.0"><body>
+<outline type="rss" text="Typed" xmlUrl="http://example.com/typed.xml"/>
+<outline text="Untyped" xmlUrl="http://example.com/untyped.xml"/>
+<outline text="Tech">
+	<outline text="Go" xmlUrl="http://example.com/go.xml"/>
+	<outline text="Languages">
+		<outline type="rss" text="Rust" xmlUrl="http://example.com/rust.xml"/>
+	</outline>
+	<outline text="Empty group"/>
+</outline>
+<outline text="Feed with children" xmlUrl="http://example.com/parent.xml">
+	<outline text="Child" xmlUrl="http://example.com/child.xml"/>
+</outline>
+</body></opml>`
+	feeds, err := parseOPMLBytes([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, feed := range feeds {
+		got = append(got, feed.URL+" "+strings.Join(feed.Category, "/"))
+	}
+	want := []string{
+		"http://example.com/typed.xml ",
+		"http://example.com/untyped.xml ",
+		"http://example.com/go.xml Tech",
+		"http://example.com/rust.xml Tech/Languages",
+		"http://example.com/parent.xml ",
+		"http://example.com/child.xml Feed with children",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFetchBodyLimit(t *testing.T) {
+	big := strings.Repeat(" ", 2000) + testFeed
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write([]byte(big))
+		case "/bomb":
+			// Small on the wire, but too big once decompressed.
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compress(t, "gzip", []byte(big)))
+		default:
+			w.Write([]byte(testFeed))
+		}
+	}))
+	defer srv.Close()
+	defer func(n int64) { *maxBody = n }(*maxBody)
+	*maxBody = 1000
+
+	if _, err := fetchFeed(context.Background(), srv.Client(), srv.URL+"/small", time.Second, validators{}, credentials{}); err != nil {
+		t.Errorf("small body: %v", err)
+	}
+	for _, path := range []string{"/big", "/bomb"} {
+		_, err := fetchFeed(context.Background(), srv.Client(), srv.URL+path, time.Second, validators{}, credentials{})
+		if !errors.Is(err, errBodyTooLarge) {
+			t.Errorf("%s: got %v, want errBodyTooLarge", path, err)
+		}
+	}
+}
+
+func TestGroupByDay(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.UTC
+	at := func(day, hour int) Entry {
+		return Entry{EntryTitle: fmt.Sprintf("%d/%d", day, hour), Time: time.Date(2024, 1, day, hour, 0, 0, 0, time.UTC), HasDate: true}
+	}
+	entries := []Entry{at(2, 9), at(2, 8), at(1, 23), {EntryTitle: "undated", Time: time.Now()}}
+
+	var got []string
+	for _, group := range groupByDay(entries) {
+		var titles []string
+		for _, entry := range group.Entries {
+			titles = append(titles, entry.EntryTitle)
+		}
+		got = append(got, group.Date+": "+strings.Join(titles, ", "))
+	}
+	want := []string{
+		"Tuesday 2 January 2024: 2/9, 2/8",
+		"Monday 1 January 2024: 1/23",
+		"Undated: undated",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseCleansTitles(t *testing.T) {
+	for _, test := range []struct {
+		title, want string
+	}{
+		{"Fish &amp; Chips", "Fish & Chips"},
+		{"Fish &amp;amp; Chips", "Fish & Chips"},
+		{"&#8220;Quoted&#x201D;", "“Quoted”"},
+		{"<![CDATA[Fish &amp; Chips]]>", "Fish & Chips"},
+		{"<![CDATA[ Fish & Chips ]]>", "Fish & Chips"},
+		// Escaped twice on purpose, to talk about the entity itself.
+		{"Writing &amp;amp;amp; in HTML", "Writing &amp; in HTML"},
+		{"The &amp;lt;b&amp;gt; tag", "The <b> tag"},
+	} {
+		feed := `<rss version="2.0"><channel><title>Fish &amp;amp; Co</title>
+<item><title>` + test.title + `</title><author>x@example.com (Chip &amp;amp; Dale)</author><link>http://example.com/1</link></item>
+</channel></rss>`
+		got := mustParse(t, "", feed)
+		if len(got.Entries) != 1 {
+			t.Fatalf("%q: got %d entries, want 1", test.title, len(got.Entries))
+		}
+		entry := got.Entries[0]
+		if entry.EntryTitle != test.want {
+			t.Errorf("%q: got title %q, want %q", test.title, entry.EntryTitle, test.want)
+		}
+		if entry.Author != "Chip & Dale" || entry.SourceTitle != "Fish & Co" {
+			t.Errorf("%q: got author %q and source %q", test.title, entry.Author, entry.SourceTitle)
+		}
+	}
+}
+
+func TestParseResolvesLinks(t *testing.T) {
+	for _, test := range []struct {
+		name, feed string
+	}{
+		{"rss", `<rss version="2.0"><channel><title>T</title>
+<item><title>a</title><link>http://other.example.com/post/1</link></item>
+<item><title>b</title><link>/post/2</link></item>
+<item><title>c</title><link>post/3</link></item>
+</channel></rss>`},
+		{"atom", `<feed xmlns="http://www.w3.org/2005/Atom"><title>T</title>
+<entry><title>a</title><link href="http://other.example.com/post/1"/></entry>
+<entry><title>b</title><link href="/post/2"/></entry>
+<entry><title>c</title><link href="post/3"/></entry>
+</feed>`},
+	} {
+		got := mustParse(t, "http://example.com/blog/feed.xml", test.feed)
+		var links []string
+		for _, entry := range got.Entries {
+			links = append(links, entry.Link)
+		}
+		want := []string{"http://other.example.com/post/1", "http://example.com/post/2", "http://example.com/blog/post/3"}
+		if !reflect.DeepEqual(links, want) {
+			t.Errorf("%s: got %q, want %q", test.name, links, want)
+		}
+	}
+}
+
+func TestParseResolvesLinksAgainstXMLBase(t *testing.T) {
+	const feed = `<feed xmlns="http://www.w3.org/2005/Atom" xml:base="http://example.com/site/"><title>T</title>
+<entry><title>a</title><link href="post/1"/></entry>
+<entry xml:base="/archive/"><title>b</title><link href="post/2"/></entry>
+</feed>`
+	got := mustParse(t, "http://feeds.example.net/feed.xml", feed)
+	var links []string
+	for _, entry := range got.Entries {
+		links = append(links, entry.Link)
+	}
+	want := []string{"http://example.com/site/post/1", "http://example.com/archive/post/2"}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got %q, want %q", links, want)
+	}
+}
+
+func TestParseSkipsBOMAndWhitespace(t *testing.T) {
+	for _, test := range []struct {
+		name, prefix, feed string
+	}{
+		{"rss after BOM", "\ufeff", testFeed},
+		{"rss after blank lines", "\n\n  \r\n\t", testFeed},
+		{"json after BOM and whitespace", "\ufeff \n", `{"version": "https://jsonfeed.org/version/1.1", "title": "T", "items": [{"id": "1", "url": "http://example.com/1", "title": "One"}]}`},
+	} {
+		got, err := parseFeed("", []byte(test.prefix+test.feed))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(got.Entries) != 1 || got.Entries[0].EntryTitle != "One" {
+			t.Errorf("%s: got entries %+v", test.name, got.Entries)
+		}
+	}
+}
+
+func TestParseDateEpoch(t *testing.T) {
+	for _, test := range []struct {
+		date string
+		want time.Time
+	}{
+		{"1704103200", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{"1704103200123", time.Date(2024, 1, 1, 10, 0, 0, 123e6, time.UTC)},
+		{"Mon, 01 Jan 2024 10:00:00 GMT", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-01-01T10:00:00Z", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+	} {
+		got, err := parseDate(test.date)
+		if err != nil {
+			t.Errorf("%q: %v", test.date, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("%q: got %v, want %v", test.date, got.UTC(), test.want)
+		}
+	}
+	// A date written without separators isn't taken for a timestamp.
+	if got, err := parseDate("20240101"); err == nil {
+		t.Errorf("20240101 got %v, want an error", got)
+	}
+	if _, err := parseDate("  "); !errors.Is(err, errNoDate) {
+		t.Errorf("blank date got %v, want errNoDate", err)
+	}
+}
+
+func TestParseDateZones(t *testing.T) {
+	for _, test := range []struct {
+		date string
+		want time.Time
+	}{
+		{"Mon, 01 Jan 2024 10:00:00 EST", time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC)},
+		{"Mon, 01 Jul 2024 10:00:00 PDT", time.Date(2024, 7, 1, 17, 0, 0, 0, time.UTC)},
+		{"Mon, 01 Jan 2024 10:00:00 UT", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{"Mon, 01 Jan 2024 10:00:00 GMT", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{"Mon, 01 Jul 2024 10:00:00 cest", time.Date(2024, 7, 1, 8, 0, 0, 0, time.UTC)},
+		{"Mon, 01 Jan 2024 10:00:00 +0530", time.Date(2024, 1, 1, 4, 30, 0, 0, time.UTC)},
+	} {
+		got, err := parseDate(test.date)
+		if err != nil {
+			t.Errorf("%q: %v", test.date, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("%q: got %v, want %v", test.date, got.UTC(), test.want)
+		}
+	}
+}
+
+func TestFetchConvertsToUTF8(t *testing.T) {
+	// "Café – naïve", with an en dash, in Windows-1252.
+	title := "Caf\xe9 \x96 na\xefve"
+	for _, test := range []struct {
+		name, contentType, decl string
+	}{
+		{"charset header", "application/rss+xml; charset=iso-8859-1", ""},
+		{"no charset", "application/rss+xml", ""},
+		{"claims UTF-8", "application/rss+xml; charset=utf-8", ""},
+		{"declared encoding", "application/rss+xml", ` encoding="windows-1252"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := `<?xml version="1.0"` + test.decl + `?>
+<rss version="2.0"><channel><title>Test</title>
+<item><title>` + title + `</title><link>http://example.com/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+</channel></rss>`
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+
+			res, err := fetchFeed(context.Background(), srv.Client(), srv.URL, time.Second, validators{}, credentials{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			feed := mustParse(t, res.url, string(res.body))
+			if len(feed.Entries) != 1 {
+				t.Fatalf("got entries %+v", feed.Entries)
+			}
+			if got, want := feed.Entries[0].EntryTitle, "Café – naïve"; got != want {
+				t.Errorf("got title %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTemplateDeclaresLanguage(t *testing.T) {
+	defer func(l string) { *lang = l }(*lang)
+	*lang = "en-GB"
+	funcs := template.FuncMap{
+		"stale": func() string { return "" },
+		"lang":  func() string { return *lang },
+	}
+	tmpl := template.Must(template.New("feeds").Funcs(funcs).Parse(feedTmpl))
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<html lang="en-GB">`, `charset=utf-8`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %s:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestParseITunesDuration(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"2700", 45 * time.Minute},
+		{" 90.5 ", 90*time.Second + 500*time.Millisecond},
+		{"5:07", 5*time.Minute + 7*time.Second},
+		{"1:05:00", time.Hour + 5*time.Minute},
+		{"", 0},
+		{"soon", 0},
+		{"1:-5", 0},
+		{"1:2:3:4", 0},
+	} {
+		if got := parseITunesDuration(test.in); got != test.want {
+			t.Errorf("parseITunesDuration(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseITunes(t *testing.T) {
+	feed := mustParse(t, "http://example.com/feed", `<?xml version="1.0"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel><title>Show</title>
+<itunes:author>The Host</itunes:author><itunes:image href="/show.jpg"/>
+<item><title>One</title><link>http://example.com/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate>
+<itunes:duration>1:05:00</itunes:duration><itunes:author>A Guest</itunes:author>
+<itunes:image href="http://example.com/1.jpg"/><itunes:summary>About one.</itunes:summary></item>
+<item><title>Two</title><link>http://example.com/2</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate>
+<itunes:duration>45:00</itunes:duration></item>
+</channel></rss>`)
+	if len(feed.Entries) != 2 {
+		t.Fatalf("got entries %+v", feed.Entries)
+	}
+	one, two := feed.Entries[0], feed.Entries[1]
+	if one.Duration != time.Hour+5*time.Minute || one.Author != "A Guest" || one.ImageURL != "http://example.com/1.jpg" || one.Description != "About one." {
+		t.Errorf("got first entry %+v", one)
+	}
+	// The second entry falls back to the show's author and artwork.
+	if two.Duration != 45*time.Minute || two.Author != "The Host" || two.ImageURL != "http://example.com/show.jpg" {
+		t.Errorf("got second entry %+v", two)
+	}
+}
+
+func TestParseChannelDateFallback(t *testing.T) {
+	for _, test := range []struct {
+		name, channel string
+		want          time.Time
+	}{
+		{"pubDate", "<pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate><lastBuildDate>Tue, 03 Jan 2006 15:04:05 GMT</lastBuildDate>", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"lastBuildDate", "<lastBuildDate>Tue, 03 Jan 2006 15:04:05 GMT</lastBuildDate>", time.Date(2006, 1, 3, 15, 4, 5, 0, time.UTC)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			feed := mustParse(t, "http://example.com/feed", `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test</title>`+test.channel+`
+<item><title>One</title><link>http://example.com/1</link></item>
+<item><title>Two</title><link>http://example.com/2</link><pubDate>Wed, 04 Jan 2006 15:04:05 GMT</pubDate></item>
+</channel></rss>`)
+			if len(feed.Entries) != 2 {
+				t.Fatalf("got entries %+v", feed.Entries)
+			}
+			if got := feed.Entries[0]; !got.Time.Equal(test.want) || !got.HasDate {
+				t.Errorf("got undated entry at %v (HasDate %v), want %v", got.Time, got.HasDate, test.want)
+			}
+			if got, want := feed.Entries[1].Time, time.Date(2006, 1, 4, 15, 4, 5, 0, time.UTC); !got.Equal(want) {
+				t.Errorf("got dated entry at %v, want its own date %v", got, want)
+			}
+		})
+	}
+}
+
+func TestClientUsesProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests to a proxy give the whole URL rather than just its path.
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(testFeed))
+	}))
+	defer proxy.Close()
+	u, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newClient(nil, http.ProxyURL(u))
+	res, err := fetchFeed(context.Background(), client, "http://feeds.invalid/feed", time.Second, validators{}, credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed := mustParse(t, res.url, string(res.body)); len(feed.Entries) != 1 {
+		t.Errorf("got entries %+v", feed.Entries)
+	}
+	if want := []string{"http://feeds.invalid/feed"}; !reflect.DeepEqual(proxied, want) {
+		t.Errorf("proxy got requests %q, want %q", proxied, want)
+	}
+}
+
+func TestFetchUsesDeclaredEncoding(t *testing.T) {
+	for _, test := range []struct {
+		encoding, title, want string
+	}{
+		// ISO-8859-1 is read as its Windows-1252 superset, as browsers do.
+		{"ISO-8859-1", "Caf\xe9 \x96 na\xefve", "Café – naïve"},
+		// IBM437 is only in the IANA registry.
+		{"IBM437", "Caf\x82 \xc4 na\x8bve", "Café ─ naïve"},
+	} {
+		t.Run(test.encoding, func(t *testing.T) {
+			body := `<?xml version="1.0" encoding="` + test.encoding + `"?>
+<rss version="2.0"><channel><title>Test</title>
+<item><title>` + test.title + `</title><link>http://example.com/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+</channel></rss>`
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+
+			res, err := fetchFeed(context.Background(), srv.Client(), srv.URL, time.Second, validators{}, credentials{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			feed := mustParse(t, res.url, string(res.body))
+			if len(feed.Entries) != 1 {
+				t.Fatalf("got entries %+v", feed.Entries)
+			}
+			if got := feed.Entries[0].EntryTitle; got != test.want {
+				t.Errorf("got title %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestXMLEncoding(t *testing.T) {
+	for _, test := range []struct {
+		doc, want string
+	}{
+		{`<?xml version="1.0" encoding="ISO-8859-1"?><rss/>`, "ISO-8859-1"},
+		{"\ufeff \n<?xml version='1.0' encoding='windows-1252'?><rss/>", "windows-1252"},
+		{`<?xml version="1.0"?><rss encoding="koi8-r"/>`, ""},
+		{`<rss/>`, ""},
+	} {
+		if got := xmlEncoding([]byte(test.doc)); got != test.want {
+			t.Errorf("xmlEncoding(%q) = %q, want %q", test.doc, got, test.want)
+		}
+	}
+}
+
+func TestClientTransportFromFlags(t *testing.T) {
+	defer func(n int, d time.Duration, c int, r float64) {
+		*maxIdleConns, *idleTimeout, *maxConnsPerHost, *requestRate = n, d, c, r
+	}(*maxIdleConns, *idleTimeout, *maxConnsPerHost, *requestRate)
+	*maxIdleConns, *idleTimeout, *maxConnsPerHost, *requestRate = 12, 5*time.Minute, 3, 2
+
+	client := newClient(map[string]int{"example.com": 1}, nil)
+	// Dig through the rate and host limits to the underlying transport.
+	rt := client.Transport
+	for {
+		switch t := rt.(type) {
+		case *rateLimitTransport:
+			rt = t.base
+			continue
+		case *hostLimitTransport:
+			rt = t.base
+			continue
+		}
+		break
+	}
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		t.Fatalf("got transport %T", rt)
+	}
+	if transport.MaxIdleConnsPerHost != 12 || transport.IdleConnTimeout != 5*time.Minute || transport.MaxConnsPerHost != 3 {
+		t.Errorf("got MaxIdleConnsPerHost %d, IdleConnTimeout %v, MaxConnsPerHost %d", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout, transport.MaxConnsPerHost)
+	}
+}
+
+func TestParseAtomDates(t *testing.T) {
+	const (
+		updated   = "<updated>2024-03-01T12:00:00Z</updated>"
+		published = "<published>2024-01-01T12:00:00Z</published>"
+	)
+	updatedTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	publishedTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer func(b bool) { *usePublished = b }(*usePublished)
+	for _, test := range []struct {
+		name, dates  string
+		usePublished bool
+		want         time.Time
+	}{
+		{"both", updated + published, false, updatedTime},
+		{"both using published", updated + published, true, publishedTime},
+		{"updated only", updated, false, updatedTime},
+		{"updated only using published", updated, true, updatedTime},
+		{"published only", published, false, publishedTime},
+		{"published only using published", published, true, publishedTime},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			*usePublished = test.usePublished
+			feed := mustParse(t, "http://example.com/feed", `<feed xmlns="http://www.w3.org/2005/Atom"><title>Test</title>
+<entry><title>One</title><link href="http://example.com/1"/>`+test.dates+`</entry>
+</feed>`)
+			if len(feed.Entries) != 1 {
+				t.Fatalf("got entries %+v", feed.Entries)
+			}
+			if got := feed.Entries[0].Time; !got.Equal(test.want) {
+				t.Errorf("got time %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDublinCore(t *testing.T) {
+	feed := mustParse(t, "http://example.com/feed", `<?xml version="1.0"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel><title>Journal</title></channel>
+<item><title>Dublin Core only</title><link>http://example.com/1</link>
+<dc:creator>A. Researcher</dc:creator><dc:date>2024-01-02T15:04:05Z</dc:date>
+<dc:subject>Physics</dc:subject><dc:subject> </dc:subject><dc:subject>Optics</dc:subject></item>
+</rdf:RDF>`)
+	if len(feed.Entries) != 1 {
+		t.Fatalf("got entries %+v", feed.Entries)
+	}
+	got := feed.Entries[0]
+	if got.Author != "A. Researcher" || !reflect.DeepEqual(got.Categories, []string{"Physics", "Optics"}) {
+		t.Errorf("got author %q and categories %q", got.Author, got.Categories)
+	}
+	if want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC); !got.Time.Equal(want) {
+		t.Errorf("got time %v, want %v", got.Time, want)
+	}
+
+	// Standard RSS fields win over Dublin Core ones.
+	feed = mustParse(t, "http://example.com/feed", `<?xml version="1.0"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><channel><title>Journal</title>
+<item><title>Both</title><link>http://example.com/2</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate>
+<author>Editor</author><dc:creator>A. Researcher</dc:creator>
+<category>News</category><dc:subject>Physics</dc:subject></item>
+</channel></rss>`)
+	if len(feed.Entries) != 1 {
+		t.Fatalf("got entries %+v", feed.Entries)
+	}
+	got = feed.Entries[0]
+	if got.Author != "Editor" || !reflect.DeepEqual(got.Categories, []string{"News"}) {
+		t.Errorf("got author %q and categories %q, want the standard fields", got.Author, got.Categories)
+	}
+}
+
+func TestParseContentEncoded(t *testing.T) {
+	feed := mustParse(t, "http://example.com/feed", `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><title>Blog</title>
+<item><title>One</title><link>http://example.com/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate>
+<description>A short blurb.</description>
+<content:encoded><![CDATA[<p>The <em>whole</em> article.</p>]]></content:encoded></item>
+<item><title>Two</title><link>http://example.com/2</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate>
+<description>Only a blurb.</description></item>
+</channel></rss>`)
+	if len(feed.Entries) != 2 {
+		t.Fatalf("got entries %+v", feed.Entries)
+	}
+	one, two := feed.Entries[0], feed.Entries[1]
+	if one.Description != "A short blurb." || one.Content != "<p>The <em>whole</em> article.</p>" {
+		t.Errorf("got description %q and content %q", one.Description, one.Content)
+	}
+	if got, want := one.Summary(), "The whole article."; got != want {
+		t.Errorf("got summary %q, want the content's %q", got, want)
+	}
+	if got, want := two.Summary(), "Only a blurb."; got != want {
+		t.Errorf("got summary %q, want the description's %q", got, want)
+	}
+}
+
+func TestParseToleratesCaseAndNamespaces(t *testing.T) {
+	for _, test := range []struct {
+		name, feed string
+	}{
+		{"uppercase rss", `<RSS VERSION="2.0"><Channel><Title>Test</Title>
+<Item><Title>One</Title><LINK>http://example.com/1</LINK><PubDate>Mon, 02 Jan 2006 15:04:05 GMT</PubDate></Item>
+<ITEM><TITLE>Two</TITLE><Link>http://example.com/2</Link><PUBDATE>Mon, 02 Jan 2006 15:04:05 GMT</PUBDATE></ITEM>
+</Channel></RSS>`},
+		{"uppercase atom", `<Feed xmlns="http://www.w3.org/2005/Atom"><TITLE>Test</TITLE>
+<Entry><Title>One</Title><LINK HREF="http://example.com/1"/><Updated>2006-01-02T15:04:05Z</Updated></Entry>
+<ENTRY><title>Two</title><Link Href="http://example.com/2"/><UPDATED>2006-01-02T15:04:05Z</UPDATED></ENTRY>
+</Feed>`},
+		{"default namespace rss", `<rss version="2.0" xmlns="http://backend.userland.com/rss2"><channel><title>Test</title>
+<item><title>One</title><link>http://example.com/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+<item><title>Two</title><link>http://example.com/2</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+</channel></rss>`},
+		{"prefixed rss", `<r:rss version="2.0" xmlns:r="urn:example:rss"><r:channel><r:title>Test</r:title>
+<r:item><r:title>One</r:title><r:link>http://example.com/1</r:link><r:pubDate>Mon, 02 Jan 2006 15:04:05 GMT</r:pubDate></r:item>
+<item><x:title xmlns:x="urn:example:other">Two</x:title><link>http://example.com/2</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+</r:channel></r:rss>`},
+		{"prefixed atom", `<a:feed xmlns:a="http://www.w3.org/2005/Atom"><a:title>Test</a:title>
+<a:entry><a:title>One</a:title><a:link href="http://example.com/1"/><a:updated>2006-01-02T15:04:05Z</a:updated></a:entry>
+<a:entry><a:title>Two</a:title><a:link href="http://example.com/2"/><a:updated>2006-01-02T15:04:05Z</a:updated></a:entry>
+</a:feed>`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			feed := mustParse(t, "http://example.com/feed", test.feed)
+			if feed.Title != "Test" {
+				t.Errorf("got title %q", feed.Title)
+			}
+			var got []string
+			for _, entry := range feed.Entries {
+				got = append(got, entry.EntryTitle+" "+entry.Link)
+			}
+			if want := []string{"One http://example.com/1", "Two http://example.com/2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got entries %q, want %q", got, want)
+			}
+		})
+	}
+}
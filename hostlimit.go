@@ -0,0 +1,221 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// parseHostLimits reads per-host connection limits, one host=n pair per line.
+// Blank lines and lines starting with # are ignored.
+func parseHostLimits(r io.Reader) (map[string]int, error) {
+	limits := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: %q is not of the form host=n", lineNo, line)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("line %d: %q does not end in a positive number", lineNo, line)
+		}
+		limits[strings.ToLower(strings.TrimSpace(host))] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// hostLimitTransport limits the number of requests in flight to particular
+// hosts, for servers that can't cope with the transport's usual per-host
+// limit. A request holds its slot until its response body is closed.
+type hostLimitTransport struct {
+	base   http.RoundTripper
+	limits map[string]int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimitTransport(base http.RoundTripper, limits map[string]int) *hostLimitTransport {
+	return &hostLimitTransport{base: base, limits: limits, slots: make(map[string]chan struct{})}
+}
+
+func (t *hostLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	limit, ok := t.limits[host]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	t.mu.Lock()
+	slots, ok := t.slots[host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		t.slots[host] = slots
+	}
+	t.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { <-slots }) }
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// releasingBody gives up a hostLimitTransport slot when it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// rateLimitTransport spaces out requests to each host, so that an OPML file
+// with many feeds on one host doesn't send them all at once. Redirects and
+// retries count against the limit too. Requests should wait their turn with
+// waitTurn before their timeout starts, or the transport makes them wait
+// within it.
+type rateLimitTransport struct {
+	base  http.RoundTripper
+	limit rate.Limit
+	burst int
+
+	limiters sync.Map // host -> *rate.Limiter
+}
+
+func newRateLimitTransport(base http.RoundTripper, limit rate.Limit, burst int) *rateLimitTransport {
+	return &rateLimitTransport{base: base, limit: limit, burst: burst}
+}
+
+func (t *rateLimitTransport) limiter(host string) *rate.Limiter {
+	limiter, ok := t.limiters.Load(host)
+	if !ok {
+		limiter, _ = t.limiters.LoadOrStore(host, rate.NewLimiter(t.limit, t.burst))
+	}
+	return limiter.(*rate.Limiter)
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	if turn, ok := req.Context().Value(turnKey{}).(*turn); ok && turn.host == host && turn.used.CompareAndSwap(false, true) {
+		return t.base.RoundTrip(req)
+	}
+	if err := t.limiter(host).Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// turn is a request to host that has already waited for the rate limit. It
+// lets the first request to that host through without waiting again; any
+// others, such as redirects back to the host, still wait.
+type turn struct {
+	host string
+	used atomic.Bool
+}
+
+type turnKey struct{}
+
+// waitTurn waits until client's rate limit lets a request to rawURL through,
+// and returns a context for the request that won't be made to wait again.
+// Waiting under ctx rather than the request's own timeout means feeds queued
+// behind many others on the same host don't time out before they are even
+// requested.
+func waitTurn(ctx context.Context, client *http.Client, rawURL string) (context.Context, error) {
+	t, ok := client.Transport.(*rateLimitTransport)
+	if !ok {
+		return ctx, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// The request will fail anyway, with a better error.
+		return ctx, nil
+	}
+	host := strings.ToLower(u.Hostname())
+	limiter := t.limiter(host)
+	if !limiter.Allow() {
+		// Give up any fetch slot while waiting, so that other hosts'
+		// feeds can be fetched meanwhile.
+		slot, _ := ctx.Value(slotKey{}).(*fetchSlot)
+		slot.release()
+		err := limiter.Wait(ctx)
+		if err == nil {
+			err = slot.acquire(ctx)
+		}
+		if err != nil {
+			return ctx, err
+		}
+	}
+	return context.WithValue(ctx, turnKey{}, &turn{host: host}), nil
+}
+
+type slotKey struct{}
+
+// fetchSlot is a feed's place among the -concurrency feeds being fetched at
+// once. It is carried in the context so that waitTurn can give it up while
+// waiting for the rate limit. A nil *fetchSlot is never held.
+type fetchSlot struct {
+	sem  chan struct{}
+	held bool
+}
+
+func (s *fetchSlot) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.sem <- struct{}{}:
+		s.held = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *fetchSlot) release() {
+	if s != nil && s.held {
+		<-s.sem
+		s.held = false
+	}
+}
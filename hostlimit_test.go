@@ -0,0 +1,143 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseHostLimits(t *testing.T) {
+	const file = `# Small blogs that can't cope
+slow.example.com = 1
+Shared.Example.com=2
+
+`
+	got, err := parseHostLimits(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"slow.example.com": 1, "shared.example.com": 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"example.com", "example.com=0", "example.com=many"} {
+		if _, err := parseHostLimits(strings.NewReader(bad)); err == nil {
+			t.Errorf("parsing %q succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestHostLimitTransport(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := make(map[string]int), make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight[r.Host]++
+		peak[r.Host] = max(peak[r.Host], inFlight[r.Host])
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight[r.Host]--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	// The same server under two names, only one of them limited.
+	limited := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	client := &http.Client{Transport: newHostLimitTransport(http.DefaultTransport, map[string]int{"localhost": 1})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		for _, u := range []string{limited, srv.URL} {
+			wg.Add(1)
+			go func(u string) {
+				defer wg.Done()
+				res, err := client.Get(u)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+			}(u)
+		}
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if got := peak[strings.TrimPrefix(limited, "http://")]; got != 1 {
+		t.Errorf("got %d requests at once to the limited host, want 1", got)
+	}
+	if got := peak[strings.TrimPrefix(srv.URL, "http://")]; got < 2 {
+		t.Errorf("got %d requests at once to the other host, want more than 1", got)
+	}
+}
+
+func TestRateLimitSpacesRequests(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 20, 1)}
+
+	for i := 0; i < 5; i++ {
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	// At 20 a second each request comes 50ms after the last; allow for
+	// the timer being a little early.
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 40*time.Millisecond {
+			t.Errorf("request %d came %v after the one before, want about 50ms", i, gap)
+		}
+	}
+}
+
+func TestRateLimitWaitIsOutsideTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 10, 1)}
+
+	// The last of these is only let through after 400ms, well past the
+	// timeout, but the timeout only starts once it is.
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = fetchFeed(context.Background(), client, srv.URL, 150*time.Millisecond, validators{}, credentials{})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("fetch %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A host is given this many times its usual response time, so that an
+	// ordinary slow response doesn't time out.
+	latencyHeadroom = 3
+	// The most a host's timeout is stretched to, as a multiple of the usual
+	// timeout, so that a host that has stopped responding altogether can't
+	// hold up a run for long.
+	maxTimeoutStretch = 4
+)
+
+// hostLatencies tracks how long each host usually takes to respond, across
+// runs, so that consistently slow hosts can be given longer than the rest. A
+// nil *hostLatencies is valid and never changes a timeout.
+type hostLatencies struct {
+	mu sync.Mutex
+	// hosts holds a moving average of the response time of each host.
+	hosts map[string]time.Duration
+}
+
+// loadLatencies reads the latencies saved at path. A missing file gives no
+// latencies.
+func loadLatencies(path string) (*hostLatencies, error) {
+	l := &hostLatencies{hosts: make(map[string]time.Duration)}
+	if path == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading host latencies: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.hosts); err != nil {
+		return nil, fmt.Errorf("decoding host latencies: %w", err)
+	}
+	return l, nil
+}
+
+// save writes the latencies to path.
+func (l *hostLatencies) save(path string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	data, err := json.Marshal(l.hosts)
+	l.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("encoding host latencies: %w", err)
+	}
+	return writeCacheFile(path, data)
+}
+
+// timeout returns how long to give a request to host, which is base unless
+// the host is usually slow enough to need longer.
+func (l *hostLatencies) timeout(host string, base time.Duration) time.Duration {
+	if l == nil {
+		return base
+	}
+	l.mu.Lock()
+	latency, ok := l.hosts[strings.ToLower(host)]
+	l.mu.Unlock()
+	if !ok {
+		return base
+	}
+	return min(max(latencyHeadroom*latency, base), maxTimeoutStretch*base)
+}
+
+// observe records that a request to host took d. Recent responses count for
+// more than older ones, so a host that speeds up is soon given less time.
+func (l *hostLatencies) observe(host string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old, ok := l.hosts[host]; ok {
+		d = (3*old + d) / 4
+	}
+	l.hosts[host] = d
+}
+
+// roundTripTimer adds up how long each round trip of a request takes, from
+// getting a connection to the first byte of the response. Time spent before
+// that, waiting for a rate limit or a host slot, isn't the server's doing and
+// is left out.
+type roundTripTimer struct {
+	start time.Time
+	total time.Duration
+}
+
+// trace returns a context for a request that times it with t. The request's
+// round trips happen one after another, and each has finished by the time
+// the client returns its response, so t needs no locking.
+func (t *roundTripTimer) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:              func(string) { t.start = time.Now() },
+		GotFirstResponseByte: func() { t.total += time.Since(t.start) },
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLatenciesTimeout(t *testing.T) {
+	l := &hostLatencies{hosts: make(map[string]time.Duration)}
+	base := 10 * time.Second
+	if got := l.timeout("example.com", base); got != base {
+		t.Errorf("unknown host got %v, want %v", got, base)
+	}
+	l.observe("Fast.example.com", time.Second)
+	if got := l.timeout("fast.example.com", base); got != base {
+		t.Errorf("fast host got %v, want %v", got, base)
+	}
+	l.observe("slow.example.com", 5*time.Second)
+	if got := l.timeout("slow.example.com", base); got != 15*time.Second {
+		t.Errorf("slow host got %v, want 15s", got)
+	}
+	l.observe("dead.example.com", time.Minute)
+	if got := l.timeout("dead.example.com", base); got != 40*time.Second {
+		t.Errorf("very slow host got %v, want the cap of 40s", got)
+	}
+	var none *hostLatencies
+	none.observe("example.com", time.Minute)
+	if got := none.timeout("example.com", base); got != base {
+		t.Errorf("nil latencies got %v, want %v", got, base)
+	}
+}
+
+func TestElapsedLeavesOutWaiting(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ask the first request to come back a second later.
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+	// The retry also has to wait for the rate limit, which lets only one
+	// request through every half second.
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 2, 1)}
+
+	start := time.Now()
+	res, err := fetchWithRetries(context.Background(), client, srv.URL, 5*time.Second, validators{}, credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatalf("fetch took %v, so didn't wait as asked", time.Since(start))
+	}
+	if res.elapsed <= 0 || res.elapsed > 250*time.Millisecond {
+		t.Errorf("elapsed is %v, want only the time spent on the final request", res.elapsed)
+	}
+}
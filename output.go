@@ -0,0 +1,353 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// atomOut is an Atom 1.0 document aggregating every output entry.
+type atomOut struct {
+	XMLName xml.Name       `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string         `xml:"title"`
+	ID      string         `xml:"id"`
+	Updated string         `xml:"updated"`
+	Author  atomOutAuthor  `xml:"author"`
+	Entries []atomOutEntry `xml:"entry"`
+}
+
+// atomOutAuthor is required at the feed level, as entries don't carry their
+// own authors.
+type atomOutAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomOutEntry struct {
+	Title   string `xml:"title"`
+	Link    link   `xml:"link"`
+	Updated string `xml:"updated"`
+	ID      string `xml:"id"`
+}
+
+// writeAtom writes entries, which must already be sorted newest first, as an
+// Atom feed.
+func writeAtom(w io.Writer, entries []Entry) error {
+	updated := time.Now()
+	if len(entries) > 0 {
+		updated = entries[0].Time
+	}
+	feed := atomOut{
+		Title:   "Eris Feeds",
+		ID:      "urn:eris:feeds",
+		Updated: updated.Format(time.RFC3339),
+		Author:  atomOutAuthor{Name: "Eris"},
+	}
+	for _, entry := range entries {
+		feed.Entries = append(feed.Entries, atomOutEntry{
+			Title:   entry.EntryTitle,
+			Link:    link{Href: entry.Link, Rel: "alternate"},
+			Updated: entry.Time.Format(time.RFC3339),
+			ID:      atomID(entry),
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// atomID returns the id for entry in Atom output: its link, or for entries
+// without one, a URN that stays the same from run to run, since an empty id
+// makes the feed invalid.
+func atomID(entry Entry) string {
+	if entry.Link != "" {
+		return entry.Link
+	}
+	key := entry.ID
+	if key == "" {
+		key = entry.EntryTitle + "\x00" + entry.Time.Format(time.RFC3339)
+	}
+	id := sha256.Sum256([]byte(entry.FeedURL + "\x00" + key))
+	return "urn:eris:entry:" + hex.EncodeToString(id[:16])
+}
+
+// rssOut is an RSS 2.0 document aggregating every output entry. The rss and
+// item types used for parsing can't be reused, as they would write out every
+// extension element they know about, empty or not.
+type rssOut struct {
+	XMLName xml.Name      `xml:"rss"`
+	Version string        `xml:"version,attr"`
+	Channel rssOutChannel `xml:"channel"`
+}
+
+type rssOutChannel struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description"`
+	Items       []rssOutItem `xml:"item"`
+}
+
+type rssOutItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description,omitempty"`
+	PubDate     string       `xml:"pubDate,omitempty"`
+	GUID        rssOutGUID   `xml:"guid"`
+	Categories  []string     `xml:"category"`
+	Enclosure   *Enclosure   `xml:"enclosure,omitempty"`
+	Source      rssOutSource `xml:"source"`
+}
+
+type rssOutGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// rssOutSource names the feed an item came from.
+type rssOutSource struct {
+	URL   string `xml:"url,attr"`
+	Title string `xml:",chardata"`
+}
+
+// writeRSS writes entries, which must already be sorted newest first, as an
+// RSS 2.0 feed. Undated entries are left without a pubDate rather than given
+// a made up one.
+func writeRSS(w io.Writer, entries []Entry) error {
+	feed := rssOut{
+		Version: "2.0",
+		Channel: rssOutChannel{
+			Title:       "Eris Feeds",
+			Link:        "https://github.com/admacleod/eris",
+			Description: "Entries gathered by eris",
+		},
+	}
+	for _, entry := range entries {
+		item := rssOutItem{
+			Title:       entry.EntryTitle,
+			Link:        entry.Link,
+			Description: entry.Description,
+			GUID:        rssOutGUID{IsPermaLink: true, ID: entry.Link},
+			Categories:  entry.Categories,
+			Source:      rssOutSource{URL: entry.FeedURL, Title: entry.SourceTitle},
+		}
+		if entry.HasDate {
+			item.PubDate = entry.Time.Format(time.RFC1123Z)
+		}
+		if entry.ID != "" {
+			// IDs are only promised to be unique within their feed.
+			item.GUID = rssOutGUID{ID: entry.FeedURL + "#" + entry.ID}
+		}
+		if entry.Enclosure.URL != "" {
+			enclosure := entry.Enclosure
+			item.Enclosure = &enclosure
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeText writes one line per entry, for reading in a terminal or an email.
+func writeText(w io.Writer, entries []Entry) error {
+	for _, entry := range entries {
+		date := entry.Time.Local().Format("2006-01-02")
+		if !entry.HasDate {
+			date = "undated"
+		}
+		if _, err := fmt.Fprintf(w, "[%s] %s — %s\n", date, singleLine(entry.EntryTitle), singleLine(entry.Link)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mboxAddress is the address every message in the mbox output comes from.
+// Only the display name varies.
+const mboxAddress = "eris@localhost"
+
+// mboxWidth is the column the bodies of mbox messages are wrapped at.
+const mboxWidth = 72
+
+// writeMbox writes entries as an mbox file with one message per entry, for
+// reading in a mail client. Bodies are the full text of the entry as plain
+// text, followed by the link. Lines starting with "From ", however many >
+// come first, get another > in front, so that readers can undo it.
+func writeMbox(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		name := entry.SourceTitle
+		if entry.Author != "" {
+			name = entry.Author + " (" + entry.SourceTitle + ")"
+		}
+		from := mail.Address{Name: singleLine(name), Address: mboxAddress}
+		id := sha256.Sum256([]byte(entry.FeedURL + "\x00" + entry.ID + "\x00" + entry.Link))
+		fmt.Fprintf(bw, "From %s %s\n", mboxAddress, entry.Time.UTC().Format(time.ANSIC))
+		fmt.Fprintf(bw, "From: %s\n", from.String())
+		fmt.Fprintf(bw, "Subject: %s\n", mime.QEncoding.Encode("utf-8", singleLine(entry.EntryTitle)))
+		fmt.Fprintf(bw, "Date: %s\n", entry.Time.Format(time.RFC1123Z))
+		fmt.Fprintf(bw, "Message-ID: <%s@eris>\n", hex.EncodeToString(id[:16]))
+		fmt.Fprintf(bw, "MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 8bit\n\n")
+		var body []string
+		if text := stripHTML(entry.Text()); text != "" {
+			body = append(wrap(text, mboxWidth), "")
+		}
+		body = append(body, singleLine(entry.Link))
+		for _, line := range body {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = ">" + line
+			}
+			fmt.Fprintf(bw, "%s\n", line)
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	return bw.Flush()
+}
+
+// wrap breaks text into lines of at most width columns at spaces. Words
+// longer than width get a line of their own.
+func wrap(text string, width int) []string {
+	var lines []string
+	var line strings.Builder
+	for _, word := range strings.Fields(text) {
+		if line.Len() > 0 && len([]rune(line.String()))+1+len([]rune(word)) > width {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(word)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// singleLine replaces line breaks and other control characters in s with
+// spaces and collapses the result, so it can't break up line based output.
+func singleLine(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// jsonOutEntry is an entry in the json output. Entry itself is also stored in
+// the cache, so it keeps its own field names there.
+type jsonOutEntry struct {
+	Title       string            `json:"title"`
+	Link        string            `json:"link"`
+	Description string            `json:"description,omitempty"`
+	Content     string            `json:"content,omitempty"`
+	Time        string            `json:"time"`
+	Dated       bool              `json:"dated"`
+	ID          string            `json:"id,omitempty"`
+	Author      string            `json:"author,omitempty"`
+	Categories  []string          `json:"categories,omitempty"`
+	Enclosure   *jsonOutEnclosure `json:"enclosure,omitempty"`
+	Source      string            `json:"source"`
+	FeedURL     string            `json:"feed_url"`
+	New         bool              `json:"new,omitempty"`
+}
+
+type jsonOutEnclosure struct {
+	URL    string `json:"url"`
+	Type   string `json:"type,omitempty"`
+	Length string `json:"length,omitempty"`
+}
+
+// writeJSON writes entries as a json array.
+func writeJSON(w io.Writer, entries []Entry, pretty bool) error {
+	out := make([]jsonOutEntry, 0, len(entries))
+	for _, entry := range entries {
+		e := jsonOutEntry{
+			Title:       entry.EntryTitle,
+			Link:        entry.Link,
+			Description: entry.Description,
+			Content:     entry.Content,
+			Time:        entry.Time.Format(time.RFC3339),
+			Dated:       entry.HasDate,
+			ID:          entry.ID,
+			Author:      entry.Author,
+			Categories:  entry.Categories,
+			Source:      entry.SourceTitle,
+			FeedURL:     entry.FeedURL,
+			New:         entry.New,
+		}
+		if entry.Enclosure.URL != "" {
+			e.Enclosure = &jsonOutEnclosure{URL: entry.Enclosure.URL, Type: entry.Enclosure.Type, Length: entry.Enclosure.Length}
+		}
+		out = append(out, e)
+	}
+	encoder := json.NewEncoder(w)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(out)
+}
+
+// writeFileAtomic calls write to fill a temporary file in the same directory
+// as path, then renames it over path. Anything reading the file sees either
+// the old version or the complete new one, and if write fails the old version
+// is left alone.
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
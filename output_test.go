@@ -0,0 +1,109 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteRSSRoundTrips(t *testing.T) {
+	entries := []Entry{
+		{
+			EntryTitle:  "One & Two",
+			Link:        "http://example.com/1",
+			Description: "<p>The first post.</p>",
+			Time:        time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+			HasDate:     true,
+			ID:          "tag:example.com,2024:1",
+			Categories:  []string{"news", "go"},
+			Enclosure:   Enclosure{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: "1234"},
+			FeedURL:     "http://example.com/feed",
+			SourceTitle: "Example",
+		},
+		{
+			EntryTitle: "Undated",
+			Link:       "http://example.com/2",
+			FeedURL:    "http://example.com/feed",
+		},
+	}
+	var out bytes.Buffer
+	if err := writeRSS(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	feed := mustParse(t, "http://example.org/eris.xml", out.String())
+	if feed.Title != "Eris Feeds" {
+		t.Errorf("got title %q", feed.Title)
+	}
+	if len(feed.Entries) != len(entries) {
+		t.Fatalf("got entries %+v", feed.Entries)
+	}
+	got, want := feed.Entries[0], entries[0]
+	if got.EntryTitle != want.EntryTitle || got.Link != want.Link || got.Description != want.Description {
+		t.Errorf("got entry %+v, want %+v", got, want)
+	}
+	if !got.HasDate || !got.Time.Equal(want.Time) {
+		t.Errorf("got time %v, want %v", got.Time, want.Time)
+	}
+	if got.ID != want.FeedURL+"#"+want.ID {
+		t.Errorf("got ID %q, want it qualified by the feed", got.ID)
+	}
+	if !reflect.DeepEqual(got.Categories, want.Categories) || got.Enclosure != want.Enclosure {
+		t.Errorf("got categories %q and enclosure %+v", got.Categories, got.Enclosure)
+	}
+	if undated := feed.Entries[1]; undated.HasDate || undated.ID != "http://example.com/2" {
+		t.Errorf("got undated entry %+v, want no date and its link as the ID", undated)
+	}
+}
+
+func TestWriteAtomIDs(t *testing.T) {
+	entries := []Entry{
+		{EntryTitle: "Linked", Link: "http://example.com/1", FeedURL: "http://example.com/feed", ID: "1"},
+		{EntryTitle: "Linkless", FeedURL: "http://example.com/feed", ID: "2"},
+		{EntryTitle: "Linkless other feed", FeedURL: "http://example.org/feed", ID: "2"},
+		{EntryTitle: "Bare", FeedURL: "http://example.com/feed", Time: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	ids := func() []string {
+		var out bytes.Buffer
+		if err := writeAtom(&out, entries); err != nil {
+			t.Fatal(err)
+		}
+		feed := mustParse(t, "http://example.org/eris.xml", out.String())
+		var ids []string
+		for _, entry := range feed.Entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+	first := ids()
+	if len(first) != len(entries) {
+		t.Fatalf("got ids %q", first)
+	}
+	if first[0] != "http://example.com/1" {
+		t.Errorf("got id %q for a linked entry, want its link", first[0])
+	}
+	seen := make(map[string]bool)
+	for i, id := range first[1:] {
+		if !strings.HasPrefix(id, "urn:eris:entry:") || seen[id] {
+			t.Errorf("got id %q for %q, want a distinct URN", id, entries[i+1].EntryTitle)
+		}
+		seen[id] = true
+	}
+	if again := ids(); !reflect.DeepEqual(again, first) {
+		t.Errorf("got ids %q on the second run, want the same %q", again, first)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRobotsBody is the most of a robots.txt file that is read. Google stops at
+// 500KiB too.
+const maxRobotsBody = 500 << 10
+
+var errDisallowed = errors.New("disallowed by robots.txt")
+
+// robotsRule is one Allow or Disallow line of a robots.txt file.
+type robotsRule struct {
+	allow bool
+	// length is the length of the path pattern, longer patterns being more
+	// specific and so taking precedence.
+	length  int
+	pattern *regexp.Regexp
+}
+
+// robotsRules are the rules from a robots.txt file that apply to eris.
+type robotsRules []robotsRule
+
+// allowed reports whether the rules allow fetching path, which includes any
+// query. The longest matching rule wins, and Allow wins a tie.
+func (rules robotsRules) allowed(path string) bool {
+	best, allow := -1, true
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > best || (rule.length == best && rule.allow) {
+			best, allow = rule.length, rule.allow
+		}
+	}
+	return allow
+}
+
+// parseRobots reads the rules in a robots.txt file for the user agent with
+// product token agent, such as "eris". A group naming agent is used in
+// preference to the * group, as RFC 9309 says.
+func parseRobots(r io.Reader, agent string) robotsRules {
+	agent = strings.ToLower(agent)
+	var specific, general robotsRules
+	var hasSpecific bool
+	// The groups the current lines belong to. A group starts with one or
+	// more User-agent lines followed by rules.
+	var forAgent, forAll, inRules bool
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if inRules {
+				forAgent, forAll, inRules = false, false, false
+			}
+			switch name := strings.ToLower(value); {
+			case name == "*":
+				forAll = true
+			case name == agent:
+				forAgent, hasSpecific = true, true
+			}
+		case "allow", "disallow":
+			inRules = true
+			// An empty Disallow allows everything, which is the default.
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{allow: key == "allow", length: len(value), pattern: robotsPattern(value)}
+			if forAgent {
+				specific = append(specific, rule)
+			}
+			if forAll {
+				general = append(general, rule)
+			}
+		}
+	}
+	if hasSpecific {
+		return specific
+	}
+	return general
+}
+
+// robotsPattern compiles a robots.txt path pattern, where * matches any run of
+// characters and a trailing $ anchors the end of the path.
+func robotsPattern(path string) *regexp.Regexp {
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(path), `\*`, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// robotsChecker fetches each host's robots.txt once per run and checks feed
+// URLs against it.
+type robotsChecker struct {
+	client  *http.Client
+	timeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*robotsHost
+}
+
+// robotsHost is the robots.txt rules for one host, available once ready is
+// closed.
+type robotsHost struct {
+	ready chan struct{}
+	rules robotsRules
+}
+
+func newRobotsChecker(client *http.Client, timeout time.Duration) *robotsChecker {
+	return &robotsChecker{client: client, timeout: timeout, hosts: make(map[string]*robotsHost)}
+}
+
+// allowed reports whether the robots.txt for the host of feedURL lets eris
+// fetch it. Hosts without a robots.txt, or whose robots.txt can't be fetched,
+// allow everything.
+func (c *robotsChecker) allowed(ctx context.Context, feedURL string) bool {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Host == "" {
+		return true
+	}
+	origin := u.Scheme + "://" + u.Host
+	c.mu.Lock()
+	host, ok := c.hosts[origin]
+	if !ok {
+		host = &robotsHost{ready: make(chan struct{})}
+		c.hosts[origin] = host
+	}
+	c.mu.Unlock()
+	if !ok {
+		host.rules = c.fetch(ctx, origin+"/robots.txt")
+		close(host.ready)
+	}
+	select {
+	case <-host.ready:
+	case <-ctx.Done():
+		return true
+	}
+	return host.rules.allowed(u.RequestURI())
+}
+
+func (c *robotsChecker) fetch(ctx context.Context, robotsURL string) robotsRules {
+	ctx, err := waitTurn(ctx, c.client, robotsURL)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", robotsURL, nil)
+	if err != nil {
+		return nil
+	}
+	addIdentity(req)
+	res, err := c.client.Do(req)
+	if err != nil {
+		slog.Debug("error fetching robots.txt", "url", robotsURL, "err", err)
+		return nil
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			slog.Error("error closing response body", "url", robotsURL, "err", err)
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		// A missing robots.txt allows everything.
+		slog.Debug("no robots.txt", "url", robotsURL, "status", res.Status)
+		return nil
+	}
+	return parseRobots(io.LimitReader(res.Body, maxRobotsBody), robotsAgent())
+}
+
+// robotsAgent is the product token robots.txt files name eris by, the first
+// word of the User-Agent without any version.
+func robotsAgent() string {
+	agent := *userAgent
+	if agent == "" {
+		agent = defaultUserAgent
+	}
+	token, _, _ := strings.Cut(strings.TrimSpace(agent), " ")
+	token, _, _ = strings.Cut(token, "/")
+	return token
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRobots(t *testing.T) {
+	const robots = `# Keep crawlers out of the archive.
+User-agent: *
+Disallow: /archive/
+Allow: /archive/feed.xml
+
+User-agent: Eris
+User-agent: other
+Disallow: /private
+Allow: /private/*.rss$
+Disallow:
+`
+	for _, test := range []struct {
+		agent, path string
+		want        bool
+	}{
+		{"crawler", "/feed.xml", true},
+		{"crawler", "/archive/2020.xml", false},
+		{"crawler", "/archive/feed.xml", true},
+		// A group naming the agent replaces the * group.
+		{"eris", "/archive/2020.xml", true},
+		{"eris", "/private/feed.xml", false},
+		{"eris", "/private/feed.rss", true},
+		{"eris", "/private/feed.rss?page=2", false},
+	} {
+		rules := parseRobots(strings.NewReader(robots), test.agent)
+		if got := rules.allowed(test.path); got != test.want {
+			t.Errorf("%s fetching %s: got allowed %v, want %v", test.agent, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsChecker(t *testing.T) {
+	defer func(s string) { *userAgent = s }(*userAgent)
+	*userAgent = "eris/1.0 (+http://example.com)"
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			t.Errorf("got request for %s", r.URL)
+		}
+		fetches.Add(1)
+		w.Write([]byte("User-agent: eris\nDisallow: /private/\n"))
+	}))
+	defer srv.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	checker := newRobotsChecker(srv.Client(), time.Second)
+	for _, test := range []struct {
+		url  string
+		want bool
+	}{
+		{srv.URL + "/feed.xml", true},
+		{srv.URL + "/private/feed.xml", false},
+		{missing.URL + "/private/feed.xml", true},
+	} {
+		if got := checker.allowed(context.Background(), test.url); got != test.want {
+			t.Errorf("%s: got allowed %v, want %v", test.url, got, test.want)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched robots.txt %d times, want it cached after once", n)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// server keeps the aggregate of feeds up to date in memory and serves it over
+// HTTP, as html at / and as json at /entries.json.
+type server struct {
+	agg   *Aggregator
+	feeds []feedSource
+	// deadline, if positive, limits how long each refresh may take.
+	deadline time.Duration
+	// minEntries is how many entries a refresh must find for them to
+	// replace those already being served.
+	minEntries int
+	// saved is called after each refresh, to save the cache.
+	saved func()
+
+	// mu guards entries and updated, which is zero until the first
+	// refresh finishes, and the Stale field of agg, which the html
+	// template reads.
+	mu      sync.RWMutex
+	entries []Entry
+	updated time.Time
+}
+
+// run fetches the feeds straight away and then every interval, serving the
+// entries at addr until ctx is cancelled.
+func (s *server) run(ctx context.Context, addr string, interval time.Duration) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveHTML)
+	mux.HandleFunc("/entries.json", s.serveJSON)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	slog.Info("serving feeds", "addr", addr, "interval", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.refresh(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// refresh fetches the feeds and, unless too few entries were found, serves
+// those entries from now on. Otherwise the entries from the last good
+// refresh continue to be served, marked as stale.
+func (s *server) refresh(ctx context.Context) {
+	fetchCtx := ctx
+	if s.deadline > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, s.deadline)
+		defer cancel()
+	}
+	start := time.Now()
+	entries := s.agg.Fetch(fetchCtx, s.feeds)
+	if ctx.Err() != nil {
+		return
+	}
+	if s.saved != nil {
+		s.saved()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) == 0 || len(entries) < s.minEntries {
+		slog.Warn("too few entries, still serving the earlier ones", "entries", len(entries), "min", s.minEntries)
+		if !s.updated.IsZero() {
+			s.agg.Stale = s.updated
+			return
+		}
+	}
+	s.entries = entries
+	s.updated = start
+	s.agg.Stale = time.Time{}
+	slog.Info("refreshed feeds", "entries", len(entries), "elapsed", time.Since(start).Round(time.Millisecond))
+}
+
+func (s *server) serveHTML(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.serve(w, r, "text/html; charset=utf-8", func(buf *bytes.Buffer, entries []Entry) error {
+		return s.agg.Template.Execute(buf, groupByCategory(entries))
+	})
+}
+
+func (s *server) serveJSON(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, "application/json", func(buf *bytes.Buffer, entries []Entry) error {
+		return writeJSON(buf, entries, s.agg.Pretty)
+	})
+}
+
+// serve renders the current entries with render and writes them as a
+// response of the given content type. The whole response is rendered before
+// any of it is written, so that an error can still be reported properly.
+func (s *server) serve(w http.ResponseWriter, r *http.Request, contentType string, render func(*bytes.Buffer, []Entry) error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	s.mu.RLock()
+	updated := s.updated
+	var err error
+	if !updated.IsZero() {
+		err = render(&buf, s.entries)
+	}
+	s.mu.RUnlock()
+	if updated.IsZero() {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "still fetching feeds", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.Error("error rendering entries", "path", r.URL.Path, "err", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// store keeps entries in an SQLite database between runs, so that posts which
+// have scrolled off the end of their feed aren't lost from the output.
+type store struct {
+	db *sql.DB
+}
+
+func openStore(path string) (*store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS entries (
+		key          TEXT PRIMARY KEY,
+		title        TEXT NOT NULL,
+		link         TEXT NOT NULL,
+		description  TEXT NOT NULL,
+		author       TEXT NOT NULL,
+		source_title TEXT NOT NULL,
+		feed_url     TEXT NOT NULL,
+		id           TEXT NOT NULL,
+		time         INTEGER NOT NULL,
+		has_date     INTEGER NOT NULL,
+		first_seen   INTEGER NOT NULL
+	)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating entries table: %w", err)
+	}
+	if err := addColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+// laterColumns are the columns added to the entries table after it was first
+// created, with their definitions. Databases made before them get them added
+// with empty values, which is what entries without them would have anyway.
+var laterColumns = []struct{ name, definition string }{
+	{"content", "TEXT NOT NULL DEFAULT ''"},
+	// categories is a json array.
+	{"categories", "TEXT NOT NULL DEFAULT ''"},
+	{"enclosure_url", "TEXT NOT NULL DEFAULT ''"},
+	{"enclosure_type", "TEXT NOT NULL DEFAULT ''"},
+	{"enclosure_length", "TEXT NOT NULL DEFAULT ''"},
+	// duration is in nanoseconds.
+	{"duration", "INTEGER NOT NULL DEFAULT 0"},
+	{"image_url", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addColumns adds any of laterColumns that the entries table is missing.
+func addColumns(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('entries')`)
+	if err != nil {
+		return fmt.Errorf("listing columns: %w", err)
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("listing columns: %w", err)
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("listing columns: %w", err)
+	}
+	for _, column := range laterColumns {
+		if have[column.name] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE entries ADD COLUMN ` + column.name + ` ` + column.definition); err != nil {
+			return fmt.Errorf("adding %s column: %w", column.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+// storeKey identifies an entry in the database. IDs are only unique within a
+// feed, so they are qualified with the feed URL.
+func storeKey(entry Entry) string {
+	if entry.ID != "" {
+		return "id:" + entry.FeedURL + " " + entry.ID
+	}
+	return "link:" + entry.Link
+}
+
+// Save inserts entries into the database, updating any that are already there
+// but keeping the time they were first seen. Entries without a date of their
+// own keep the time they were first given rather than moving forward on every
+// run.
+func (s *store) Save(entries []Entry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO entries
+		(key, title, link, description, author, source_title, feed_url, id, time, has_date, first_seen,
+			content, categories, enclosure_url, enclosure_type, enclosure_length, duration, image_url)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			title = excluded.title,
+			link = excluded.link,
+			description = excluded.description,
+			author = excluded.author,
+			source_title = excluded.source_title,
+			content = excluded.content,
+			categories = excluded.categories,
+			enclosure_url = excluded.enclosure_url,
+			enclosure_type = excluded.enclosure_type,
+			enclosure_length = excluded.enclosure_length,
+			duration = excluded.duration,
+			image_url = excluded.image_url,
+			time = CASE WHEN excluded.has_date THEN excluded.time ELSE entries.time END,
+			has_date = excluded.has_date`)
+	if err != nil {
+		return fmt.Errorf("preparing insert: %w", err)
+	}
+	defer stmt.Close()
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		var categories []byte
+		if len(entry.Categories) > 0 {
+			if categories, err = json.Marshal(entry.Categories); err != nil {
+				return fmt.Errorf("encoding categories of entry %q: %w", entry.Link, err)
+			}
+		}
+		if _, err := stmt.Exec(
+			storeKey(entry),
+			entry.EntryTitle,
+			entry.Link,
+			entry.Description,
+			entry.Author,
+			entry.SourceTitle,
+			entry.FeedURL,
+			entry.ID,
+			entry.Time.UnixNano(),
+			entry.HasDate,
+			now,
+			entry.Content,
+			string(categories),
+			entry.Enclosure.URL,
+			entry.Enclosure.Type,
+			entry.Enclosure.Length,
+			int64(entry.Duration),
+			entry.ImageURL,
+		); err != nil {
+			return fmt.Errorf("saving entry %q: %w", entry.Link, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing entries: %w", err)
+	}
+	return nil
+}
+
+// Recent returns the newest n entries in the database, or all of them if n is
+// not positive.
+func (s *store) Recent(n int) ([]Entry, error) {
+	if n <= 0 {
+		// SQLite treats a negative limit as no limit.
+		n = -1
+	}
+	rows, err := s.db.Query(`SELECT title, link, description, author, source_title, feed_url, id, time, has_date,
+			content, categories, enclosure_url, enclosure_type, enclosure_length, duration, image_url
+		FROM entries ORDER BY time DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, fmt.Errorf("querying entries: %w", err)
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var nanos, duration int64
+		var categories string
+		if err := rows.Scan(
+			&entry.EntryTitle,
+			&entry.Link,
+			&entry.Description,
+			&entry.Author,
+			&entry.SourceTitle,
+			&entry.FeedURL,
+			&entry.ID,
+			&nanos,
+			&entry.HasDate,
+			&entry.Content,
+			&categories,
+			&entry.Enclosure.URL,
+			&entry.Enclosure.Type,
+			&entry.Enclosure.Length,
+			&duration,
+			&entry.ImageURL,
+		); err != nil {
+			return nil, fmt.Errorf("reading entry: %w", err)
+		}
+		entry.Time = time.Unix(0, nanos)
+		entry.Duration = time.Duration(duration)
+		if categories != "" {
+			if err := json.Unmarshal([]byte(categories), &entry.Categories); err != nil {
+				return nil, fmt.Errorf("decoding categories of entry %q: %w", entry.Link, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading entries: %w", err)
+	}
+	return entries, nil
+}
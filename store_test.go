@@ -0,0 +1,81 @@
+// Copyright (c) Alisdair MacLeod <copying@alisdairmacleod.co.uk>
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+// REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+// AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+// INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+// LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+// OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+// PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entries.db")
+	// A database from before the later columns were added.
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE entries (
+		key TEXT PRIMARY KEY, title TEXT NOT NULL, link TEXT NOT NULL,
+		description TEXT NOT NULL, author TEXT NOT NULL, source_title TEXT NOT NULL,
+		feed_url TEXT NOT NULL, id TEXT NOT NULL, time INTEGER NOT NULL,
+		has_date INTEGER NOT NULL, first_seen INTEGER NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO entries VALUES ('link:http://example.com/old', 'Old', 'http://example.com/old', '', '', 'Test', 'http://example.com/feed', '', 0, 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	want := Entry{
+		EntryTitle:  "Episode",
+		Link:        "http://example.com/1",
+		Description: "<p>Short</p>",
+		Content:     "<p>Long</p>",
+		Time:        time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		HasDate:     true,
+		ID:          "urn:1",
+		FeedURL:     "http://example.com/feed",
+		Author:      "Someone",
+		Categories:  []string{"Go", "News"},
+		Enclosure:   Enclosure{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: "1024"},
+		Duration:    90 * time.Second,
+		ImageURL:    "http://example.com/1.jpg",
+		SourceTitle: "Test",
+	}
+	if err := s.Save([]Entry{want}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Recent(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got))
+	}
+	got[0].Time = got[0].Time.UTC()
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got[0], want)
+	}
+	if got[1].EntryTitle != "Old" || got[1].Categories != nil {
+		t.Errorf("got %+v for the entry from before, want it as it was", got[1])
+	}
+}